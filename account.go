@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/LamaLamer/redigram/pipeline"
+	"github.com/LamaLamer/redigram/publish"
+	"github.com/LamaLamer/redigram/store"
+)
+
+type Account struct {
+	Name     string `json:"name"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Sub      string `json:"sub"`
+	MinScore int    `json:"minscore"`
+
+	ScorePercentile float64  `json:"score_percentile"`
+	ScoreWindow     Duration `json:"score_window"`
+	MaxMinScore     int      `json:"minscore_ceiling"`
+
+	Store    string `json:"store"`
+	Dry      bool   `json:"dry"`
+	Schedule string `json:"schedule"`
+	Quota    Quota  `json:"quota"`
+
+	Publishers []PublisherConfig `json:"publishers"`
+
+	InstagramProxy string `json:"instagram_proxy"`
+
+	// Sources are the subreddits a bandit picks Sub from on every run.
+	Sources []string     `json:"sources"`
+	Bandit  BanditConfig `json:"bandit"`
+
+	Ranking []RankingConfig `json:"ranking"`
+
+	Filter FilterConfig `json:"filter"`
+
+	// Caption is how captions are made from titles: title, hashtags or title+hashtags.
+	Caption string `json:"caption"`
+
+	// Approval makes scheduled runs publish approved queue entries only.
+	Approval bool `json:"approval"`
+
+	// TakedownWindow is how long published posts are checked for removal on Reddit.
+	TakedownWindow Duration `json:"takedown_window"`
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+type PublisherConfig struct {
+	Type string `json:"type"`
+	Dir  string `json:"dir,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+func NewPublisher(a *Account, c PublisherConfig) (publish.Publisher, error) {
+	switch c.Type {
+	case "instagram":
+		return a.Instagram(), nil
+	case "outbox":
+		if c.Dir == "" {
+			return nil, fmt.Errorf("outbox publisher needs a dir")
+		}
+		return &publish.Outbox{Dir: c.Dir}, nil
+	case "webhook":
+		if c.URL == "" {
+			return nil, fmt.Errorf("webhook publisher needs a url")
+		}
+		return &publish.Webhook{URL: c.URL, Retry: retry()}, nil
+	default:
+		return nil, fmt.Errorf("unknown publisher type %q", c.Type)
+	}
+}
+
+// Instagram returns the account's Instagram login. TLS is only left
+// unverified behind a proxy on this machine, like fakeinsta.
+func (a *Account) Instagram() *publish.Instagram {
+	return &publish.Instagram{
+		Username: a.Username,
+		Password: a.Password,
+		Proxy:    a.InstagramProxy,
+		Insecure: loopbackURL(a.InstagramProxy),
+		Retry:    retry(),
+	}
+}
+
+// loopbackURL reports whether rawurl is on a loopback address.
+func loopbackURL(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	if u.Hostname() == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(u.Hostname())
+	return ip != nil && ip.IsLoopback()
+}
+
+func retry() publish.Retry {
+	return publish.Retry{Attempts: settings.Retries, Backoff: settings.Backoff.Duration}
+}
+
+func (a *Account) NewPublishers() ([]publish.Publisher, error) {
+	if len(a.Publishers) == 0 {
+		return nil, fmt.Errorf("account %s has no publishers", a.Name)
+	}
+	var pubs []publish.Publisher
+	for _, c := range a.Publishers {
+		pub, err := NewPublisher(a, c)
+		if err != nil {
+			return nil, fmt.Errorf("account %s: %v", a.Name, err)
+		}
+		pubs = append(pubs, pub)
+	}
+	return pubs, nil
+}
+
+// Validate checks the parts of the account that are only
+// interpreted when a run gets to them.
+func (a *Account) Validate() error {
+	if a.Schedule != "" {
+		if _, err := ParseSchedule(a.Schedule); err != nil {
+			return fmt.Errorf("schedule: %v", err)
+		}
+	}
+	if _, err := a.NewPublishers(); err != nil {
+		return err
+	}
+	if a.ScorePercentile < 0 || a.ScorePercentile > 100 {
+		return fmt.Errorf("score_percentile %g is not between 0 and 100", a.ScorePercentile)
+	}
+	if _, err := a.Filter.Compile(); err != nil {
+		return fmt.Errorf("filter: %v", err)
+	}
+	if a.Filter.MinAspect > 0 && a.Filter.MaxAspect > 0 && a.Filter.MinAspect > a.Filter.MaxAspect {
+		return fmt.Errorf("filter: min_aspect %g is above max_aspect %g", a.Filter.MinAspect, a.Filter.MaxAspect)
+	}
+	if !validCaption(a.Caption) {
+		return fmt.Errorf("unknown caption style %q", a.Caption)
+	}
+	for _, rc := range a.Ranking {
+		if !rankingStrategies[rc.Strategy] {
+			return fmt.Errorf("unknown ranking strategy %q", rc.Strategy)
+		}
+		if rc.Checkpoint != "" && !store.IsCheckpoint(rc.Checkpoint) {
+			return fmt.Errorf("ranking %s: unknown checkpoint %q", rc.Strategy, rc.Checkpoint)
+		}
+	}
+	switch a.Bandit.Strategy {
+	case "", "thompson", "ucb1":
+	default:
+		return fmt.Errorf("unknown bandit strategy %q", a.Bandit.Strategy)
+	}
+	if a.Bandit.Checkpoint != "" && !store.IsCheckpoint(a.Bandit.Checkpoint) {
+		return fmt.Errorf("bandit: unknown checkpoint %q", a.Bandit.Checkpoint)
+	}
+	return nil
+}
+
+func validCaption(style string) bool {
+	for _, s := range pipeline.CaptionStyles {
+		if style == s {
+			return true
+		}
+	}
+	return style == ""
+}
+
+func (a *Account) String() string {
+	return fmt.Sprintf("%s (r/%s)", a.Name, a.Sub)
+}
+
+// Duration is a time.Duration that reads and writes
+// as a string like "90m" in JSON.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/LamaLamer/redigram/store"
+)
+
+// BanditConfig controls how the source subreddit is picked
+// when an account has more than one.
+type BanditConfig struct {
+	Strategy    string             `json:"strategy"`    // thompson or ucb1
+	Exploration float64            `json:"exploration"` // chance of a uniformly random pick
+	Floors      map[string]float64 `json:"floors"`      // minimum pick probability per source
+	Checkpoint  string             `json:"checkpoint"`  // metric checkpoint used as reward
+}
+
+type Arm struct {
+	Source string  `json:"source"`
+	Pulls  int     `json:"pulls"`
+	Scored int     `json:"scored"`
+	Reward float64 `json:"reward"` // sum of normalized rewards
+}
+
+func (a *Arm) Mean() float64 {
+	if a.Scored == 0 {
+		return 0
+	}
+	return a.Reward / float64(a.Scored)
+}
+
+type BanditSnapshot struct {
+	Time    time.Time          `json:"time"`
+	Chosen  string             `json:"chosen"`
+	Weights map[string]float64 `json:"weights"`
+}
+
+// BanditState is persisted in the store after every pick a run used.
+type BanditState struct {
+	Arms    []*Arm            `json:"arms"`
+	History []*BanditSnapshot `json:"history"`
+}
+
+const (
+	banditStateKey   = "bandit"
+	banditMaxHistory = 1000
+	thompsonDraws    = 2000
+)
+
+// buildArms rebuilds the arm statistics from the store history.
+// The reward of a post is its likes per follower at the checkpoint,
+// normalized by the best post so it falls between 0 and 1.
+func buildArms(sources []string, rr []*store.Record, checkpoint string) []*Arm {
+	arms := make([]*Arm, len(sources))
+	index := map[string]*Arm{}
+	for i, s := range sources {
+		arms[i] = &Arm{Source: s}
+		index[strings.ToLower(s)] = arms[i]
+	}
+	type sample struct {
+		arm *Arm
+		lpf float64
+	}
+	var samples []sample
+	best := 0.0
+	for _, r := range rr {
+		arm, ok := index[strings.ToLower(r.Subreddit)]
+		if !ok || r.Dry || r.Status == store.StatusFailed || r.Posted.IsZero() {
+			continue
+		}
+		arm.Pulls++
+		m := r.MetricAt(checkpoint)
+		if m == nil || m.Followers == 0 {
+			continue
+		}
+		lpf := float64(m.Likes) / float64(m.Followers)
+		samples = append(samples, sample{arm, lpf})
+		best = math.Max(best, lpf)
+	}
+	for _, s := range samples {
+		s.arm.Scored++
+		if best > 0 {
+			s.arm.Reward += s.lpf / best
+		}
+	}
+	return arms
+}
+
+// strategyWeights returns the probability of the strategy picking each arm.
+func strategyWeights(cfg BanditConfig, arms []*Arm, rng *rand.Rand) (map[string]float64, error) {
+	w := map[string]float64{}
+	switch cfg.Strategy {
+	case "", "thompson":
+		wins := map[string]int{}
+		for i := 0; i < thompsonDraws; i++ {
+			best, bestDraw := "", -1.0
+			for _, a := range arms {
+				draw := betaSample(rng, 1+a.Reward, 1+float64(a.Scored)-a.Reward)
+				if draw > bestDraw {
+					best, bestDraw = a.Source, draw
+				}
+			}
+			wins[best]++
+		}
+		for _, a := range arms {
+			w[a.Source] = float64(wins[a.Source]) / thompsonDraws
+		}
+	case "ucb1":
+		total := 0
+		for _, a := range arms {
+			total += a.Scored
+		}
+		best, bestScore := []string{}, math.Inf(-1)
+		for _, a := range arms {
+			score := math.Inf(1)
+			if a.Scored > 0 {
+				score = a.Mean() + math.Sqrt(2*math.Log(float64(total))/float64(a.Scored))
+			}
+			switch {
+			case score > bestScore:
+				best, bestScore = []string{a.Source}, score
+			case score == bestScore:
+				best = append(best, a.Source)
+			}
+		}
+		for _, s := range best {
+			w[s] = 1 / float64(len(best))
+		}
+	default:
+		return nil, fmt.Errorf("unknown bandit strategy %q", cfg.Strategy)
+	}
+	return w, nil
+}
+
+// BanditWeights mixes the strategy with exploration and floors
+// into the final pick probability of every source.
+func BanditWeights(cfg BanditConfig, arms []*Arm, rng *rand.Rand) (map[string]float64, error) {
+	sw, err := strategyWeights(cfg, arms, rng)
+	if err != nil {
+		return nil, err
+	}
+	floors := 0.0
+	for _, a := range arms {
+		floors += cfg.Floors[a.Source]
+	}
+	if floors > 1 {
+		return nil, fmt.Errorf("bandit floors add up to %v, more than 1", floors)
+	}
+	n := float64(len(arms))
+	w := map[string]float64{}
+	for _, a := range arms {
+		p := (1-cfg.Exploration)*sw[a.Source] + cfg.Exploration/n
+		w[a.Source] = cfg.Floors[a.Source] + (1-floors)*p
+	}
+	return w, nil
+}
+
+func pickWeighted(w map[string]float64, order []*Arm, rng *rand.Rand) string {
+	u := rng.Float64()
+	for _, a := range order {
+		u -= w[a.Source]
+		if u < 0 {
+			return a.Source
+		}
+	}
+	return order[len(order)-1].Source
+}
+
+// SourcePick is the subreddit ChooseSource picked. The bandit decision
+// behind it is only saved by Record, once the run goes on to use it.
+type SourcePick struct {
+	Source string
+
+	arms     []*Arm
+	snapshot *BanditSnapshot
+}
+
+// ChooseSource picks the subreddit the account posts from next.
+// The store is not changed.
+func ChooseSource(a *Account, st *store.Store) (*SourcePick, error) {
+	if len(a.Sources) == 0 {
+		return &SourcePick{Source: a.Sub}, nil
+	}
+	if len(a.Sources) == 1 {
+		return &SourcePick{Source: a.Sources[0]}, nil
+	}
+	rr, err := st.Records()
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := a.Bandit.Checkpoint
+	if checkpoint == "" {
+		checkpoint = "24h"
+	}
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	arms := buildArms(a.Sources, rr, checkpoint)
+	w, err := BanditWeights(a.Bandit, arms, rng)
+	if err != nil {
+		return nil, err
+	}
+	chosen := pickWeighted(w, arms, rng)
+	return &SourcePick{
+		Source: chosen,
+		arms:   arms,
+		snapshot: &BanditSnapshot{
+			Time:    time.Now(),
+			Chosen:  chosen,
+			Weights: w,
+		},
+	}, nil
+}
+
+// Record adds the decision to the bandit history of the store.
+// Picks among fewer than two sources are not decisions.
+func (p *SourcePick) Record(st *store.Store) error {
+	if p.snapshot == nil {
+		return nil
+	}
+	unlock, err := st.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	var state BanditState
+	if err := st.GetState(banditStateKey, &state); err != nil {
+		return err
+	}
+	state.Arms = p.arms
+	state.History = append(state.History, p.snapshot)
+	if n := len(state.History); n > banditMaxHistory {
+		state.History = state.History[n-banditMaxHistory:]
+	}
+	return st.PutState(banditStateKey, &state)
+}
+
+func RunBanditReport(a *Account) error {
+	var state BanditState
+	if err := store.New(a.Store).GetState(banditStateKey, &state); err != nil {
+		return err
+	}
+	return WriteBanditReport(os.Stdout, &state, 20)
+}
+
+// WriteBanditReport prints the arms and how their weights
+// changed over the last n picks.
+func WriteBanditReport(out io.Writer, state *BanditState, n int) error {
+	if len(state.Arms) == 0 {
+		fmt.Fprintln(out, "no bandit decisions yet")
+		return nil
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tPOSTS\tSCORED\tMEAN REWARD")
+	for _, a := range state.Arms {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.3f\n", a.Source, a.Pulls, a.Scored, a.Mean())
+	}
+	fmt.Fprintln(w)
+	fmt.Fprint(w, "TIME\tCHOSEN")
+	for _, a := range state.Arms {
+		fmt.Fprintf(w, "\t%s", a.Source)
+	}
+	fmt.Fprintln(w)
+	hist := state.History
+	if len(hist) > n {
+		hist = hist[len(hist)-n:]
+	}
+	for _, h := range hist {
+		fmt.Fprintf(w, "%s\t%s", h.Time.Format(time.RFC3339), h.Chosen)
+		for _, a := range state.Arms {
+			fmt.Fprintf(w, "\t%.2f", h.Weights[a.Source])
+		}
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
+
+// betaSample draws from Beta(a, b) using two gamma draws.
+func betaSample(rng *rand.Rand, a, b float64) float64 {
+	x := gammaSample(rng, a)
+	y := gammaSample(rng, b)
+	return x / (x + y)
+}
+
+// gammaSample draws from Gamma(k, 1) with the Marsaglia and Tsang method.
+func gammaSample(rng *rand.Rand, k float64) float64 {
+	if k < 1 {
+		return gammaSample(rng, k+1) * math.Pow(rng.Float64(), 1/k)
+	}
+	d := k - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rng.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rng.Float64()
+		if math.Log(u) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
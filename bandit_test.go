@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/LamaLamer/redigram/store"
+)
+
+func TestBuildArms(t *testing.T) {
+	posted := time.Now()
+	rec := func(sub string, likes, followers int) *store.Record {
+		r := &store.Record{Subreddit: sub, Posted: posted}
+		if followers > 0 {
+			r.Metrics = []*store.Metric{{Checkpoint: "24h", Likes: likes, Followers: followers}}
+		}
+		return r
+	}
+	failed := rec("memes", 100, 100)
+	failed.Status = store.StatusFailed
+	dry := rec("memes", 100, 100)
+	dry.Dry = true
+	rr := []*store.Record{
+		rec("Memes", 20, 100), // the best post, reward 1
+		rec("memes", 10, 100),
+		rec("memes", 0, 0), // not measured yet
+		rec("cats", 5, 100),
+		rec("dogs", 50, 100), // not a source
+		failed,
+		dry,
+	}
+	arms := buildArms([]string{"memes", "cats", "birds"}, rr, "24h")
+	want := []Arm{
+		{Source: "memes", Pulls: 3, Scored: 2, Reward: 1.5},
+		{Source: "cats", Pulls: 1, Scored: 1, Reward: 0.25},
+		{Source: "birds"},
+	}
+	for i, a := range arms {
+		w := want[i]
+		if a.Source != w.Source || a.Pulls != w.Pulls || a.Scored != w.Scored || math.Abs(a.Reward-w.Reward) > 1e-9 {
+			t.Errorf("arm %d = %+v, want %+v", i, *a, w)
+		}
+	}
+	if arms := buildArms([]string{"memes"}, rr, "7d"); arms[0].Scored != 0 || arms[0].Pulls != 3 {
+		t.Errorf("other checkpoint: %+v", *arms[0])
+	}
+}
+
+func TestBanditWeights(t *testing.T) {
+	arms := []*Arm{
+		{Source: "a", Pulls: 10, Scored: 10, Reward: 9},
+		{Source: "b", Pulls: 10, Scored: 10, Reward: 1},
+		{Source: "c"},
+	}
+	tests := []struct {
+		name string
+		cfg  BanditConfig
+		want map[string]float64 // nil when it fails
+	}{
+		{"ucb1 tries untried arms first", BanditConfig{Strategy: "ucb1"}, map[string]float64{"a": 0, "b": 0, "c": 1}},
+		{"ucb1 with exploration", BanditConfig{Strategy: "ucb1", Exploration: 0.3}, map[string]float64{"a": 0.1, "b": 0.1, "c": 0.8}},
+		{"floors", BanditConfig{Strategy: "ucb1", Floors: map[string]float64{"a": 0.2, "b": 0.3}}, map[string]float64{"a": 0.2, "b": 0.3, "c": 0.5}},
+		{"floors and exploration", BanditConfig{Strategy: "ucb1", Exploration: 0.3, Floors: map[string]float64{"a": 0.5}}, map[string]float64{"a": 0.55, "b": 0.05, "c": 0.4}},
+		{"floors above 1", BanditConfig{Strategy: "ucb1", Floors: map[string]float64{"a": 0.6, "b": 0.6}}, nil},
+		{"unknown strategy", BanditConfig{Strategy: "greedy"}, nil},
+	}
+	for _, tt := range tests {
+		w, err := BanditWeights(tt.cfg, arms, rand.New(rand.NewSource(1)))
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", tt.name, w)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		for s, p := range tt.want {
+			if math.Abs(w[s]-p) > 1e-9 {
+				t.Errorf("%s: weights %v, want %v", tt.name, w, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestBanditWeightsThompson(t *testing.T) {
+	arms := []*Arm{
+		{Source: "a", Pulls: 20, Scored: 20, Reward: 18},
+		{Source: "b", Pulls: 20, Scored: 20, Reward: 2},
+	}
+	w, err := BanditWeights(BanditConfig{Exploration: 0.1}, arms, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := w["a"] + w["b"]; math.Abs(sum-1) > 1e-9 {
+		t.Errorf("weights %v add up to %v", w, sum)
+	}
+	// b still gets its share of exploration
+	if w["a"] < 0.9 || w["b"] < 0.05 {
+		t.Errorf("weights %v", w)
+	}
+}
+
+func TestPickWeighted(t *testing.T) {
+	arms := []*Arm{{Source: "a"}, {Source: "b"}, {Source: "c"}}
+	w := map[string]float64{"a": 0.2, "b": 0, "c": 0.8}
+	rng := rand.New(rand.NewSource(1))
+	picks := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		picks[pickWeighted(w, arms, rng)]++
+	}
+	if picks["b"] != 0 || picks["a"] < 150 || picks["a"] > 250 {
+		t.Errorf("picks %v", picks)
+	}
+}
+
+// Only runs that post leave a pick in the bandit history.
+func TestChooseSourceRecordsUsedPicks(t *testing.T) {
+	e := newTestEnv(t)
+	e.a.Sources = []string{"memes", "memes"}
+	e.a.Quota.PerDay = 1
+	history := func() int {
+		var state BanditState
+		if err := e.st.GetState(banditStateKey, &state); err != nil {
+			t.Fatal(err)
+		}
+		return len(state.History)
+	}
+	if _, err := ChooseSource(e.a, e.st); err != nil {
+		t.Fatal(err)
+	}
+	if n := history(); n != 0 {
+		t.Fatalf("picking saved %d decisions", n)
+	}
+	e.a.MinScore = 100000
+	if err := DoPost(context.Background(), e.a); err == nil {
+		t.Fatal("posted without candidates")
+	}
+	if n := history(); n != 0 {
+		t.Fatalf("a run without candidates saved %d decisions", n)
+	}
+	e.a.MinScore = 0
+	if err := DoPost(context.Background(), e.a); err != nil {
+		t.Fatal(err)
+	}
+	if n := history(); n != 1 {
+		t.Fatalf("%d decisions after posting, want 1", n)
+	}
+	if _, ok := DoPost(context.Background(), e.a).(*QuotaError); !ok {
+		t.Fatal("the quota did not stop the second run")
+	}
+	if n := history(); n != 1 {
+		t.Errorf("%d decisions after a run stopped by the quota, want 1", n)
+	}
+}
@@ -0,0 +1,70 @@
+// Package caption builds Instagram captions from submission titles.
+package caption
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/jdkato/prose.v2"
+)
+
+const MaxLen = 2000
+
+// Make turns the nouns and adjectives of s into hashtags.
+func Make(s string) (tags string, err error) {
+	defer func() {
+		// prose panics when its model can't be loaded
+		if r := recover(); r != nil {
+			tags, err = "", fmt.Errorf("tagging %q: %v", s, r)
+		}
+	}()
+	doc, err := prose.NewDocument(s, prose.WithExtraction(false), prose.WithSegmentation(false))
+	if err != nil {
+		return "", err
+	}
+	seen := map[string]bool{}
+	var caption strings.Builder
+	for _, tok := range doc.Tokens() {
+		if len(tok.Text) < 2 || seen[tok.Text] {
+			continue
+		}
+		seen[tok.Text] = true
+		if caption.Len()+len(tok.Text) > MaxLen {
+			break
+		}
+		switch tok.Tag {
+		case "NNP", "NN", "JJ":
+			fmt.Fprintf(&caption, "#%s ", tok.Text)
+		}
+	}
+	return caption.String(), nil
+}
+
+// Hashtags returns the lower cased hashtags of a caption.
+func Hashtags(caption string) []string {
+	var tags []string
+	for _, f := range strings.Fields(caption) {
+		if len(f) > 1 && f[0] == '#' {
+			tags = append(tags, strings.ToLower(f))
+		}
+	}
+	return tags
+}
+
+// Style describes how a caption was put together.
+func Style(caption, title string) string {
+	hasTags := len(Hashtags(caption)) > 0
+	hasTitle := title != "" && strings.Contains(caption, title)
+	switch {
+	case hasTitle && hasTags:
+		return "title+hashtags"
+	case hasTitle:
+		return "title"
+	case hasTags:
+		return "hashtags"
+	case caption == "":
+		return "empty"
+	default:
+		return "custom"
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// flagTable is the set of options every command accepts. Flags are applied
+// on top of the config file in the order they are registered, so -outbox
+// and -webhook see the publishers set by -publish.
+type flagTable struct {
+	fs    *flag.FlagSet
+	names []string
+	apply map[string]func(a *Account) error
+}
+
+func (t *flagTable) add(name string, apply func(a *Account) error) {
+	t.names = append(t.names, name)
+	t.apply[name] = apply
+}
+
+func envName(flagName string) string {
+	return "REDIGRAM_" + strings.ToUpper(flagName)
+}
+
+// Apply copies the flags given on the command line onto a, and the
+// settings. With env set REDIGRAM_<FLAG> variables fill in the rest.
+func (t *flagTable) Apply(a *Account, env bool) error {
+	visited := map[string]bool{}
+	t.fs.Visit(func(f *flag.Flag) { visited[f.Name] = true })
+	for _, name := range t.names {
+		if !visited[name] {
+			v, ok := os.LookupEnv(envName(name))
+			if !env || !ok {
+				continue
+			}
+			if err := t.fs.Set(name, v); err != nil {
+				return fmt.Errorf("invalid value %q for %s: %v", v, envName(name), err)
+			}
+		}
+		if err := t.apply[name](a); err != nil {
+			return fmt.Errorf("-%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func commonFlags(fs *flag.FlagSet) *flagTable {
+	t := &flagTable{fs: fs, apply: map[string]func(a *Account) error{}}
+	d, ds := DefaultAccount(), DefaultSettings()
+
+	username := fs.String("username", d.Username, "Instagram Username")
+	t.add("username", func(a *Account) error { a.Username = *username; return nil })
+	password := fs.String("password", d.Password, "Instagram Password")
+	t.add("password", func(a *Account) error { a.Password = *password; return nil })
+	sub := fs.String("sub", d.Sub, "The Subreddit to pull from")
+	t.add("sub", func(a *Account) error { a.Sub = *sub; return nil })
+	storedir := fs.String("store", d.Store, "Storage directory")
+	t.add("store", func(a *Account) error { a.Store = *storedir; return nil })
+	minscore := fs.Int("minscore", d.MinScore, "Minimum score, the floor when -percentile is set")
+	t.add("minscore", func(a *Account) error { a.MinScore = *minscore; return nil })
+	dry := fs.Bool("dry", d.Dry, "Don't actually post the image")
+	t.add("dry", func(a *Account) error { a.Dry = *dry; return nil })
+
+	maxhour := fs.Int("maxhour", 0, "Maximum posts per rolling hour (0 for no limit)")
+	t.add("maxhour", func(a *Account) error { a.Quota.PerHour = *maxhour; return nil })
+	maxday := fs.Int("maxday", 0, "Maximum posts per rolling day (0 for no limit)")
+	t.add("maxday", func(a *Account) error { a.Quota.PerDay = *maxday; return nil })
+	mingap := fs.Duration("mingap", 0, "Minimum time between posts")
+	t.add("mingap", func(a *Account) error { a.Quota.MinGap = Duration{*mingap}; return nil })
+
+	publishers := fs.String("publish", "instagram", "Comma separated publishers: instagram, outbox, webhook")
+	outbox := fs.String("outbox", "outbox", "Directory used by the outbox publisher")
+	webhook := fs.String("webhook", "", "URL used by the webhook publisher")
+	t.add("publish", func(a *Account) error {
+		a.Publishers = nil
+		for _, typ := range splitList(*publishers) {
+			c := PublisherConfig{Type: typ}
+			switch typ {
+			case "outbox":
+				c.Dir = *outbox
+			case "webhook":
+				c.URL = *webhook
+			}
+			a.Publishers = append(a.Publishers, c)
+		}
+		return nil
+	})
+	t.add("outbox", func(a *Account) error {
+		for i := range a.Publishers {
+			if a.Publishers[i].Type == "outbox" {
+				a.Publishers[i].Dir = *outbox
+			}
+		}
+		return nil
+	})
+	t.add("webhook", func(a *Account) error {
+		for i := range a.Publishers {
+			if a.Publishers[i].Type == "webhook" {
+				a.Publishers[i].URL = *webhook
+			}
+		}
+		return nil
+	})
+
+	instaproxy := fs.String("instaproxy", d.InstagramProxy, "Proxy URL for Instagram API requests, TLS is not verified behind one on a loopback address")
+	t.add("instaproxy", func(a *Account) error { a.InstagramProxy = *instaproxy; return nil })
+
+	sources := fs.String("sources", "", "Comma separated subreddits to choose -sub from with a bandit")
+	t.add("sources", func(a *Account) error { a.Sources = splitList(*sources); return nil })
+	strategy := fs.String("strategy", d.Bandit.Strategy, "Bandit strategy: thompson or ucb1")
+	t.add("strategy", func(a *Account) error { a.Bandit.Strategy = *strategy; return nil })
+	explore := fs.Float64("explore", d.Bandit.Exploration, "Bandit exploration rate")
+	t.add("explore", func(a *Account) error { a.Bandit.Exploration = *explore; return nil })
+
+	percentile := fs.Float64("percentile", d.ScorePercentile, "Derive the minimum score from this percentile of recent listing scores (0 to use -minscore)")
+	t.add("percentile", func(a *Account) error {
+		if *percentile < 0 || *percentile > 100 {
+			return fmt.Errorf("%g is not between 0 and 100", *percentile)
+		}
+		a.ScorePercentile = *percentile
+		return nil
+	})
+	window := fs.Duration("window", d.ScoreWindow.Duration, "How long listing scores are kept for -percentile")
+	t.add("window", func(a *Account) error { a.ScoreWindow = Duration{*window}; return nil })
+	maxminscore := fs.Int("maxminscore", d.MaxMinScore, "Ceiling of the derived minimum score (0 for none)")
+	t.add("maxminscore", func(a *Account) error { a.MaxMinScore = *maxminscore; return nil })
+
+	rank := fs.String("rank", "score", "Comma separated ranking strategies with optional weights, e.g. velocity:2,score:1\n"+
+		"strategies: score, velocity, comments, random, fresh, model")
+	t.add("rank", func(a *Account) error {
+		rcs, err := ParseRanking(*rank)
+		a.Ranking = rcs
+		return err
+	})
+
+	nsfw := fs.Bool("nsfw", false, "Allow submissions marked NSFW")
+	t.add("nsfw", func(a *Account) error { a.Filter.AllowNSFW = *nsfw; return nil })
+	spoilers := fs.Bool("spoilers", false, "Allow submissions marked as spoilers")
+	t.add("spoilers", func(a *Account) error { a.Filter.AllowSpoilers = *spoilers; return nil })
+	maxage := fs.Duration("maxage", 0, "Skip submissions older than this (0 for no limit)")
+	t.add("maxage", func(a *Account) error { a.Filter.MaxAge = Duration{*maxage}; return nil })
+	mincomments := fs.Int("mincomments", 0, "Skip submissions with fewer comments")
+	t.add("mincomments", func(a *Account) error { a.Filter.MinComments = *mincomments; return nil })
+
+	captionStyle := fs.String("caption", d.Caption, "How captions are made from titles: title, hashtags or title+hashtags")
+	t.add("caption", func(a *Account) error { a.Caption = *captionStyle; return nil })
+
+	approval := fs.Bool("approval", d.Approval, "Only publish posts approved in the queue filled by the prepare command")
+	t.add("approval", func(a *Account) error { a.Approval = *approval; return nil })
+	takedownwindow := fs.Duration("takedownwindow", d.TakedownWindow.Duration, "Delete posts whose Reddit source is removed within this long of posting (0 to disable)")
+	t.add("takedownwindow", func(a *Account) error { a.TakedownWindow = Duration{*takedownwindow}; return nil })
+
+	// settings, the same for every profile
+	retries := fs.Int("retries", ds.Retries, "Upload retries on transient Instagram errors")
+	t.add("retries", func(*Account) error { settings.Retries = *retries; return nil })
+	backoff := fs.Duration("backoff", ds.Backoff.Duration, "Initial wait between upload retries, doubled on every attempt")
+	t.add("backoff", func(*Account) error { settings.Backoff = Duration{*backoff}; return nil })
+	notify := fs.String("notify", ds.Notify, "Shell command run when an account hits a checkpoint")
+	t.add("notify", func(*Account) error { settings.Notify = *notify; return nil })
+	jitter := fs.Duration("jitter", ds.Jitter.Duration, "Maximum random delay added to each scheduled run")
+	t.add("jitter", func(*Account) error { settings.Jitter = Duration{*jitter}; return nil })
+	collect := fs.Duration("collect", ds.CollectEvery.Duration, "How often the daemon refreshes engagement metrics (0 to disable)")
+	t.add("collect", func(*Account) error { settings.CollectEvery = Duration{*collect}; return nil })
+	watch := fs.Duration("watch", ds.WatchEvery.Duration, "How often the daemon checks posts for removal on Reddit (0 to disable)")
+	t.add("watch", func(*Account) error { settings.WatchEvery = Duration{*watch}; return nil })
+	record := fs.String("record", ds.Record, "Save every Reddit and image response into this directory")
+	t.add("record", func(*Account) error { settings.Record = *record; return nil })
+	replay := fs.String("replay", ds.Replay, "Serve Reddit and image responses from a -record directory instead of the network")
+	t.add("replay", func(*Account) error { settings.Replay = *replay; return nil })
+	out := fs.String("out", ds.Out, "Directory dry runs write candidate images and manifest.json to")
+	t.add("out", func(*Account) error { settings.Out = *out; return nil })
+	top := fs.Int("top", ds.Top, "Number of candidates rendered by a dry run")
+	t.add("top", func(*Account) error { settings.Top = *top; return nil })
+	prefetch := fs.Int("prefetch", ds.Prefetch, "Number of candidate images downloaded and checked at a time")
+	t.add("prefetch", func(*Account) error { settings.Prefetch = *prefetch; return nil })
+	workers := fs.Int("workers", ds.Workers, "Maximum number of parallel image downloads")
+	t.add("workers", func(*Account) error { settings.Workers = *workers; return nil })
+	maximagebytes := fs.Int64("maximagebytes", ds.MaxImageBytes, "Skip images larger than this many bytes (0 for no limit)")
+	t.add("maximagebytes", func(*Account) error { settings.MaxImageBytes = *maximagebytes; return nil })
+	maximagepixels := fs.Int("maximagepixels", ds.MaxImagePixels, "Skip images with more pixels than this, checked before decoding (0 for no limit)")
+	t.add("maximagepixels", func(*Account) error { settings.MaxImagePixels = *maximagepixels; return nil })
+	listingtimeout := fs.Duration("listingtimeout", ds.ListingTimeout.Duration, "Deadline for fetching a Reddit listing (0 for none)")
+	t.add("listingtimeout", func(*Account) error { settings.ListingTimeout = Duration{*listingtimeout}; return nil })
+	imagetimeout := fs.Duration("imagetimeout", ds.ImageTimeout.Duration, "Deadline for downloading an image (0 for none)")
+	t.add("imagetimeout", func(*Account) error { settings.ImageTimeout = Duration{*imagetimeout}; return nil })
+	uploadtimeout := fs.Duration("uploadtimeout", ds.UploadTimeout.Duration, "Deadline for publishing a post, retries included (0 for none)")
+	t.add("uploadtimeout", func(*Account) error { settings.UploadTimeout = Duration{*uploadtimeout}; return nil })
+	runtimeout := fs.Duration("runtimeout", ds.RunTimeout.Duration, "Deadline for a whole posting run (0 for none)")
+	t.add("runtimeout", func(*Account) error { settings.RunTimeout = Duration{*runtimeout}; return nil })
+	return t
+}
+
+// CLI resolves profiles for a command: built in defaults, then the
+// config file, then REDIGRAM_* environment variables, then flags.
+type CLI struct {
+	Config  *Config
+	Profile string
+
+	global, local *flagTable
+}
+
+func (c *CLI) Account(profile string) (*Account, error) {
+	a, err := c.Config.Profile(profile)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.global.Apply(a, true); err != nil {
+		return nil, err
+	}
+	if err := c.local.Apply(a, false); err != nil {
+		return nil, err
+	}
+	if a.Name == "" {
+		a.Name = a.Username
+	}
+	return a, nil
+}
+
+// Accounts returns every profile of the config file.
+func (c *CLI) Accounts() ([]*Account, error) {
+	var accounts []*Account
+	for _, name := range c.Config.ProfileNames() {
+		a, err := c.Account(name)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	if len(accounts) == 0 {
+		return nil, fmt.Errorf("no profiles in %s", c.Config.path)
+	}
+	return accounts, nil
+}
+
+type runFunc func(ctx context.Context, c *CLI, a *Account, args []string) error
+
+type command struct {
+	name  string
+	args  string
+	usage string
+	// flags registers the flags of the command and returns how to run it.
+	flags func(fs *flag.FlagSet) runFunc
+}
+
+func noFlags(run runFunc) func(*flag.FlagSet) runFunc {
+	return func(*flag.FlagSet) runFunc { return run }
+}
+
+var commands []*command
+
+func init() {
+	// assigned here, the daemon command refers back to commands
+	commands = []*command{
+		{"post", "", "Publish the best candidate (the default command)", noFlags(func(ctx context.Context, c *CLI, a *Account, args []string) error {
+			return DoPost(ctx, a)
+		})},
+		{"preview", "", "Render the top -top candidates and manifest.json into -out", noFlags(func(ctx context.Context, c *CLI, a *Account, args []string) error {
+			a.Dry = true
+			return DoPost(ctx, a)
+		})},
+		{"daemon", "", "Run every profile of the config file on its schedule", noFlags(func(ctx context.Context, c *CLI, a *Account, args []string) error {
+			accounts, err := c.Accounts()
+			if err != nil {
+				return err
+			}
+			return RunDaemon(ctx, accounts)
+		})},
+		{"store", "list|show <id>|rm <id>", "Inspect the store", noFlags(func(ctx context.Context, c *CLI, a *Account, args []string) error {
+			return RunStore(a, args)
+		})},
+		{"collect", "", "Sample engagement of published posts", noFlags(func(ctx context.Context, c *CLI, a *Account, args []string) error {
+			return Collect(ctx, a)
+		})},
+		{"stats", "", "Report engagement", func(fs *flag.FlagSet) runFunc {
+			at := fs.String("at", "24h", "Checkpoint to report: 1h, 6h, 24h, 7d or latest")
+			return func(ctx context.Context, c *CLI, a *Account, args []string) error {
+				return RunStats(a, *at)
+			}
+		}},
+		{"rank", "", "Rank candidates with the engagement model", func(fs *flag.FlagSet) runFunc {
+			explain := fs.Bool("explain", false, "Print the contribution of every feature")
+			at := fs.String("at", "", "Engagement checkpoint the model is trained on (default the checkpoint of the model ranking, or 24h)")
+			return func(ctx context.Context, c *CLI, a *Account, args []string) error {
+				if *at == "" {
+					*at = ModelCheckpoint(a)
+				}
+				return RunRank(ctx, a, *at, *explain)
+			}
+		}},
+		{"bandit", "", "Report the subreddit bandit", noFlags(func(ctx context.Context, c *CLI, a *Account, args []string) error {
+			return RunBanditReport(a)
+		})},
+		{"filter", "", "List the candidates that pass the filters", func(fs *flag.FlagSet) runFunc {
+			explain := fs.Bool("explain", false, "Show the rule that rejected every submission")
+			return func(ctx context.Context, c *CLI, a *Account, args []string) error {
+				return RunFilter(ctx, a, *explain)
+			}
+		}},
+		{"watch", "", "Take down posts whose Reddit source was removed", noFlags(func(ctx context.Context, c *CLI, a *Account, args []string) error {
+			return Watch(ctx, a)
+		})},
+		{"takedown", "<reddit id|permalink|instagram code>", "Remove a post and blocklist its author", func(fs *flag.FlagSet) runFunc {
+			by := fs.String("by", "", "Who asked for the removal")
+			reason := fs.String("reason", "removal requested", "Why the post is taken down")
+			return func(ctx context.Context, c *CLI, a *Account, args []string) error {
+				if len(args) != 1 {
+					return fmt.Errorf("usage: takedown [-by name] [-reason text] <reddit id|permalink|instagram code>")
+				}
+				return RunTakedown(ctx, a, args[0], *by, *reason)
+			}
+		}},
+		{"prepare", "", "Render the top candidates into the approval queue", func(fs *flag.FlagSet) runFunc {
+			n := fs.Int("n", 5, "Number of posts to add to the queue")
+			return func(ctx context.Context, c *CLI, a *Account, args []string) error {
+				return RunPrepare(ctx, a, *n)
+			}
+		}},
+		{"queue", "", "List the approval queue", noFlags(func(ctx context.Context, c *CLI, a *Account, args []string) error {
+			return RunQueue(a, "queue", args)
+		})},
+		{"approve", "<id>...", "Approve queued posts", noFlags(func(ctx context.Context, c *CLI, a *Account, args []string) error {
+			return RunQueue(a, "approve", args)
+		})},
+		{"reject", "<id>...", "Reject queued posts", func(fs *flag.FlagSet) runFunc {
+			reason := fs.String("reason", "", "Why the posts are rejected, shown on the dashboard")
+			return func(ctx context.Context, c *CLI, a *Account, args []string) error {
+				return RejectQueued(a, args, *reason)
+			}
+		}},
+		{"edit-caption", "<id> <caption>", "Change the caption of a queued post", noFlags(func(ctx context.Context, c *CLI, a *Account, args []string) error {
+			return RunQueue(a, "edit-caption", args)
+		})},
+		{"serve", "", "Run the review dashboard", func(fs *flag.FlagSet) runFunc {
+			addr := fs.String("addr", "127.0.0.1:8080", "Listen address of the dashboard")
+			return func(ctx context.Context, c *CLI, a *Account, args []string) error {
+				return RunServe(ctx, a, *addr)
+			}
+		}},
+		{"review", "", "Review candidates in the terminal", func(fs *flag.FlagSet) runFunc {
+			width := fs.Int("width", 64, "Width of the image preview in columns")
+			ascii := fs.Bool("ascii", false, "Preview images in ASCII instead of ANSI colors")
+			return func(ctx context.Context, c *CLI, a *Account, args []string) error {
+				return RunReview(ctx, a, *width, *ascii)
+			}
+		}},
+		{"config", "validate", "Check the config file", noFlags(func(ctx context.Context, c *CLI, a *Account, args []string) error {
+			if len(args) != 1 || args[0] != "validate" {
+				return fmt.Errorf("usage: config validate")
+			}
+			return ValidateConfig(c.Config.path)
+		})},
+		{"fakeinsta", "", "Serve a fake Instagram API for offline runs", noFlags(func(ctx context.Context, c *CLI, a *Account, args []string) error {
+			return RunFakeInstagram(ctx)
+		})},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// configFlags registers -config and -profile, which select the
+// config file and are read before any other flag is applied.
+func configFlags(fs *flag.FlagSet) (path, profile *string) {
+	path = fs.String("config", "", "JSON config file with settings and profiles (default redigram.json, $REDIGRAM_CONFIG)")
+	profile = fs.String("profile", "", "Profile of the config file to use ($REDIGRAM_PROFILE)")
+	return path, profile
+}
+
+// RunCLI runs redigram [flags] [command] [flags] [args].
+// Flags are accepted before the command too, so older invocations keep working.
+// After the command they win over the ones before it.
+func RunCLI(args []string) error {
+	top := flag.NewFlagSet("redigram", flag.ContinueOnError)
+	configPath, profile := configFlags(top)
+	global := commonFlags(top)
+	top.Usage = func() { writeUsage(top) }
+	if err := top.Parse(args); err != nil {
+		return err
+	}
+
+	name := top.Arg(0)
+	if name == "" {
+		name = "post"
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		return fmt.Errorf("unknown command %q", name)
+	}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	localPath, localProfile := configFlags(fs)
+	local := commonFlags(fs)
+	run := cmd.flags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of redigram %s [flags] %s:\n", name, cmd.args)
+		fs.PrintDefaults()
+	}
+	if top.NArg() > 0 {
+		if err := fs.Parse(top.Args()[1:]); err != nil {
+			return err
+		}
+	}
+	if *localPath != "" {
+		*configPath = *localPath
+	}
+	if *localProfile != "" {
+		*profile = *localProfile
+	}
+
+	path, explicit := *configPath, *configPath != ""
+	if !explicit {
+		path, explicit = os.LookupEnv("REDIGRAM_CONFIG")
+	}
+	if path == "" {
+		path = "redigram.json"
+	}
+	cfg, err := LoadConfig(path, false)
+	switch {
+	case os.IsNotExist(err) && !explicit:
+		cfg = &Config{Settings: DefaultSettings(), path: path}
+	case err != nil:
+		return err
+	}
+	settings = cfg.Settings
+	if *profile == "" {
+		*profile = os.Getenv("REDIGRAM_PROFILE")
+	}
+
+	c := &CLI{Config: cfg, Profile: *profile, global: global, local: local}
+	a, err := c.Account(c.Profile)
+	if err != nil {
+		return err
+	}
+	switch {
+	case settings.Replay != "":
+		Transport = &ReplayTransport{Dir: settings.Replay}
+	case settings.Record != "":
+		Transport = &RecordingTransport{Dir: settings.Record, Next: Transport}
+	}
+	ctx, cancel := interruptContext()
+	defer cancel()
+	return run(ctx, c, a, fs.Args())
+}
+
+// interruptContext returns a context canceled by the first SIGINT or
+// SIGTERM. A second signal stops the process right away.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Printf("received %v, stopping", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	return ctx, cancel
+}
+
+func writeUsage(fs *flag.FlagSet) {
+	out := fs.Output()
+	fmt.Fprintln(out, "Usage of ./redigram [flags] [command] [flags] [args]:")
+	fmt.Fprintln(out, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %s\n    \t%s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.usage)
+	}
+	fmt.Fprintln(out, "\nFlags, also read from REDIGRAM_<FLAG> environment variables:")
+	fs.PrintDefaults()
+}
+
+// ValidateConfig strictly reads the config file and checks every profile.
+func ValidateConfig(path string) error {
+	cfg, err := LoadConfig(path, true)
+	if err != nil {
+		return err
+	}
+	names := append([]string{""}, cfg.ProfileNames()...)
+	failed := 0
+	for _, name := range names {
+		label := name
+		if label == "" {
+			label = "defaults"
+		}
+		a, err := cfg.Profile(name)
+		if err == nil {
+			err = a.Validate()
+		}
+		if err != nil {
+			fmt.Printf("%s: %v\n", label, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: ok\n", label)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%s: %d of %d profiles are invalid", path, failed, len(names))
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/LamaLamer/redigram/photo"
+)
+
+// Settings are the options shared by every profile of a config file.
+type Settings struct {
+	Retries      int      `json:"retries"`
+	Backoff      Duration `json:"backoff"`
+	Notify       string   `json:"notify"`
+	Jitter       Duration `json:"jitter"`
+	CollectEvery Duration `json:"collect"`
+	WatchEvery   Duration `json:"watch"`
+	Record       string   `json:"record"`
+	Replay       string   `json:"replay"`
+	Out          string   `json:"out"`
+	Top          int      `json:"top"`
+	Prefetch     int      `json:"prefetch"`
+	Workers      int      `json:"workers"`
+
+	// Limits of image downloads, 0 for none.
+	MaxImageBytes  int64 `json:"max_image_bytes"`
+	MaxImagePixels int   `json:"max_image_pixels"`
+
+	// Deadlines of the stages of a run and of the whole run, 0 for none.
+	ListingTimeout Duration `json:"listing_timeout"`
+	ImageTimeout   Duration `json:"image_timeout"`
+	UploadTimeout  Duration `json:"upload_timeout"`
+	RunTimeout     Duration `json:"run_timeout"`
+}
+
+func DefaultSettings() Settings {
+	return Settings{
+		Retries:      3,
+		Backoff:      Duration{30 * time.Second},
+		Jitter:       Duration{5 * time.Minute},
+		CollectEvery: Duration{30 * time.Minute},
+		WatchEvery:   Duration{15 * time.Minute},
+		Out:          ".",
+		Top:          1,
+		Prefetch:     5,
+		Workers:      4,
+
+		MaxImageBytes:  photo.DefaultLimits.MaxBytes,
+		MaxImagePixels: photo.DefaultLimits.MaxPixels,
+
+		ListingTimeout: Duration{10 * time.Second},
+		ImageTimeout:   Duration{10 * time.Second},
+		UploadTimeout:  Duration{5 * time.Minute},
+	}
+}
+
+// settings are the resolved Settings of the running command.
+var settings = DefaultSettings()
+
+// DefaultAccount has the built in defaults. Lists are left empty, an
+// account without publishers gets instagram once the config is read.
+func DefaultAccount() *Account {
+	return &Account{
+		Sub:            "memes",
+		MinScore:       100,
+		ScoreWindow:    Duration{7 * 24 * time.Hour},
+		Store:          "used",
+		Caption:        "title",
+		Bandit:         BanditConfig{Strategy: "thompson", Exploration: 0.1},
+		TakedownWindow: Duration{72 * time.Hour},
+	}
+}
+
+// Config is the JSON config file. Every profile is an account that
+// starts from Defaults, the settings apply to all of them.
+//
+//	{
+//	  "retries": 5,
+//	  "defaults": {"minscore": 500},
+//	  "profiles": {
+//	    "memes": {"username": "user", "password": "pass", "sub": "memes"}
+//	  }
+//	}
+//
+// A JSON array of accounts, the old accounts.json, is read as one
+// profile per account named by its name or username.
+type Config struct {
+	Settings
+	Defaults json.RawMessage            `json:"defaults,omitempty"`
+	Profiles map[string]json.RawMessage `json:"profiles"`
+
+	path   string
+	strict bool
+}
+
+// LoadConfig reads the config at path. When strict is set unknown
+// fields are errors, which catches misspelled options.
+func LoadConfig(path string, strict bool) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{Settings: DefaultSettings(), path: path, strict: strict}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		c.Profiles = map[string]json.RawMessage{}
+		for i, r := range raw {
+			var id struct {
+				Name     string `json:"name"`
+				Username string `json:"username"`
+			}
+			if err := json.Unmarshal(r, &id); err != nil {
+				return nil, fmt.Errorf("%s: account %d: %v", path, i+1, err)
+			}
+			name := id.Name
+			if name == "" {
+				name = id.Username
+			}
+			if name == "" {
+				name = fmt.Sprintf("account%d", i+1)
+			}
+			c.Profiles[name] = r
+		}
+		return c, nil
+	}
+	if err := c.decode(data, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+func (c *Config) decode(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if c.strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
+func (c *Config) ProfileNames() []string {
+	var names []string
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Profile returns the named account with the config defaults filled in.
+// The empty name is the defaults alone. Objects in the profile are merged
+// into the defaults, any other value replaces them.
+func (c *Config) Profile(name string) (*Account, error) {
+	layers := []json.RawMessage{c.Defaults}
+	if name != "" {
+		raw, ok := c.Profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("no profile %q in %s", name, c.path)
+		}
+		layers = append(layers, raw)
+	}
+	merged := map[string]interface{}{}
+	for _, layer := range layers {
+		if len(layer) == 0 {
+			continue
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(layer, &m); err != nil {
+			return nil, fmt.Errorf("%s: profile %s: %v", c.path, name, err)
+		}
+		mergeJSON(merged, m)
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	a := DefaultAccount()
+	if err := c.decode(data, a); err != nil {
+		return nil, fmt.Errorf("%s: profile %s: %v", c.path, name, err)
+	}
+	if len(a.Publishers) == 0 {
+		a.Publishers = []PublisherConfig{{Type: "instagram"}}
+	}
+	if a.Name == "" {
+		a.Name = name
+	}
+	if a.Name == "" {
+		a.Name = a.Username
+	}
+	return a, nil
+}
+
+func mergeJSON(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if sm, ok := v.(map[string]interface{}); ok {
+			if dm, ok := dst[k].(map[string]interface{}); ok {
+				mergeJSON(dm, sm)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeJSON(t *testing.T) {
+	tests := []struct {
+		dst, src, want string
+	}{
+		{`{}`, `{"a": 1}`, `{"a": 1}`},
+		{`{"a": 1, "b": 2}`, `{"a": 3}`, `{"a": 3, "b": 2}`},
+		{`{"o": {"x": 1, "y": 2}}`, `{"o": {"y": 3, "z": 4}}`, `{"o": {"x": 1, "y": 3, "z": 4}}`},
+		{`{"o": {"p": {"x": 1}}}`, `{"o": {"p": {"y": 2}}}`, `{"o": {"p": {"x": 1, "y": 2}}}`},
+		// lists and other values replace
+		{`{"l": [1, 2]}`, `{"l": [3]}`, `{"l": [3]}`},
+		{`{"o": {"x": 1}}`, `{"o": null}`, `{"o": null}`},
+		{`{"o": 1}`, `{"o": {"x": 1}}`, `{"o": {"x": 1}}`},
+	}
+	for _, tt := range tests {
+		var dst, src, want map[string]interface{}
+		for _, j := range []struct {
+			s string
+			v *map[string]interface{}
+		}{{tt.dst, &dst}, {tt.src, &src}, {tt.want, &want}} {
+			if err := json.Unmarshal([]byte(j.s), j.v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mergeJSON(dst, src)
+		if !reflect.DeepEqual(dst, want) {
+			t.Errorf("mergeJSON(%s, %s) = %v, want %s", tt.dst, tt.src, dst, tt.want)
+		}
+	}
+}
+
+func writeConfig(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigProfile(t *testing.T) {
+	c, err := LoadConfig(writeConfig(t, `{
+		"retries": 5,
+		"defaults": {"minscore": 500, "quota": {"per_hour": 2, "per_day": 10}, "filter": {"title_deny": ["meta"]}},
+		"profiles": {
+			"memes": {"username": "memer", "sub": "memes", "quota": {"per_day": 4}},
+			"cats": {"name": "kitties", "minscore": 50, "filter": {"title_deny": ["dog"]}, "publishers": [{"type": "webhook", "url": "http://x"}]}
+		}
+	}`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Retries != 5 || c.Backoff.Duration != 30*time.Second {
+		t.Errorf("settings %+v", c.Settings)
+	}
+	if names := c.ProfileNames(); !reflect.DeepEqual(names, []string{"cats", "memes"}) {
+		t.Errorf("profiles %v", names)
+	}
+	tests := []struct {
+		profile   string
+		name      string
+		minScore  int
+		quota     Quota
+		titleDeny []string
+		publisher string
+	}{
+		{"", "", 500, Quota{PerHour: 2, PerDay: 10}, []string{"meta"}, "instagram"},
+		{"memes", "memes", 500, Quota{PerHour: 2, PerDay: 4}, []string{"meta"}, "instagram"},
+		{"cats", "kitties", 50, Quota{PerHour: 2, PerDay: 10}, []string{"dog"}, "webhook"},
+	}
+	for _, tt := range tests {
+		a, err := c.Profile(tt.profile)
+		if err != nil {
+			t.Fatalf("profile %q: %v", tt.profile, err)
+		}
+		if a.Name != tt.name || a.MinScore != tt.minScore || !reflect.DeepEqual(a.Quota, tt.quota) ||
+			!reflect.DeepEqual(a.Filter.TitleDeny, tt.titleDeny) || len(a.Publishers) != 1 || a.Publishers[0].Type != tt.publisher {
+			t.Errorf("profile %q: %+v", tt.profile, a)
+		}
+		// built in defaults nobody overrode
+		if a.ScoreWindow.Duration != 7*24*time.Hour || a.Bandit.Strategy != "thompson" {
+			t.Errorf("profile %q lost the built in defaults: %+v", tt.profile, a)
+		}
+	}
+	if _, err := c.Profile("dogs"); err == nil {
+		t.Error("missing profile found")
+	}
+}
+
+func TestConfigStrict(t *testing.T) {
+	path := writeConfig(t, `{"profiles": {"memes": {"minscroe": 5}}}`)
+	for _, strict := range []bool{false, true} {
+		c, err := LoadConfig(path, strict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Profile("memes"); (err != nil) != strict {
+			t.Errorf("strict %v: %v", strict, err)
+		}
+	}
+	if _, err := LoadConfig(writeConfig(t, `{"retires": 5}`), true); err == nil {
+		t.Error("misspelled setting accepted")
+	}
+}
+
+func TestConfigLegacy(t *testing.T) {
+	c, err := LoadConfig(writeConfig(t, `[
+		{"name": "first", "username": "a"},
+		{"username": "b", "minscore": 5},
+		{"sub": "cats"}
+	]`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := c.ProfileNames(); !reflect.DeepEqual(names, []string{"account3", "b", "first"}) {
+		t.Fatalf("profiles %v", names)
+	}
+	a, err := c.Profile("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Name != "b" || a.Username != "b" || a.MinScore != 5 || a.Sub != "memes" {
+		t.Errorf("account %+v", a)
+	}
+}
+
+func TestConfigLegacyInvalid(t *testing.T) {
+	path := writeConfig(t, `[{"name": "first"}, {"name": 5}]`)
+	_, err := LoadConfig(path, false)
+	if err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("got %v, want an error naming %s", err, path)
+	}
+}
+
+func TestAccountValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		edit  func(a *Account)
+		valid bool
+	}{
+		{"defaults", func(a *Account) {}, true},
+		{"percentile", func(a *Account) { a.ScorePercentile = 90 }, true},
+		{"percentile 100", func(a *Account) { a.ScorePercentile = 100 }, true},
+		{"negative percentile", func(a *Account) { a.ScorePercentile = -1 }, false},
+		{"percentile above 100", func(a *Account) { a.ScorePercentile = 150 }, false},
+		{"schedule", func(a *Account) { a.Schedule = "not a schedule" }, false},
+		{"caption", func(a *Account) { a.Caption = "emoji" }, false},
+		{"aspect", func(a *Account) { a.Filter.MinAspect, a.Filter.MaxAspect = 2, 1 }, false},
+		{"bandit", func(a *Account) { a.Bandit.Strategy = "greedy" }, false},
+		{"publishers", func(a *Account) { a.Publishers = nil }, false},
+	}
+	for _, tt := range tests {
+		a := DefaultAccount()
+		a.Publishers = []PublisherConfig{{Type: "instagram"}}
+		tt.edit(a)
+		if err := a.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+// -config and -profile are accepted after the command as well.
+func TestCLIConfigFlags(t *testing.T) {
+	saved := settings
+	defer func() { settings = saved }()
+	path := writeConfig(t, fmt.Sprintf(`{"profiles": {"memes": {"store": %q}}}`, t.TempDir()))
+	for _, tt := range []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"-config", path, "-profile", "memes", "queue"}, true},
+		{[]string{"queue", "-config", path, "-profile", "memes"}, true},
+		{[]string{"-config", path, "queue", "-profile", "memes"}, true},
+		{[]string{"-profile", "memes", "queue", "-config", path}, true},
+		{[]string{"queue", "-config", path, "-profile", "cats"}, false},
+		{[]string{"-profile", "cats", "queue", "-config", path, "-profile", "memes"}, true},
+	} {
+		if err := RunCLI(tt.args); (err == nil) != tt.ok {
+			t.Errorf("%v: %v", tt.args, err)
+		}
+	}
+}
+
+// Only a proxy on this machine, like fakeinsta, gets unverified TLS.
+func TestInstagramInsecure(t *testing.T) {
+	for proxy, insecure := range map[string]bool{
+		"":                           false,
+		"http://127.0.0.1:40123":     true,
+		"http://localhost:40123":     true,
+		"http://[::1]:40123":         true,
+		"http://10.0.0.1:3128":       false,
+		"http://proxy.example:3128":  false,
+		"http://127.0.0.1.nip.io:80": false,
+	} {
+		a := DefaultAccount()
+		a.InstagramProxy = proxy
+		if got := a.Instagram().Insecure; got != insecure {
+			t.Errorf("%q: insecure %v, want %v", proxy, got, insecure)
+		}
+	}
+}
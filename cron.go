@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed five field cron expression:
+// minute, hour, day of month, month and day of week.
+type Schedule struct {
+	Spec   string
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// standard cron semantics: when both day fields are restricted
+	// a time matches if either of them does.
+	domAny  bool
+	dowAny  bool
+	hourAny bool
+}
+
+var scheduleAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+func ParseSchedule(spec string) (*Schedule, error) {
+	expr := strings.TrimSpace(spec)
+	if alias, ok := scheduleAliases[expr]; ok {
+		expr = alias
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: expected 5 fields, got %d", spec, len(fields))
+	}
+	s := &Schedule{Spec: spec}
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("schedule %q: minute: %v", spec, err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("schedule %q: hour: %v", spec, err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("schedule %q: day of month: %v", spec, err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("schedule %q: month: %v", spec, err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("schedule %q: day of week: %v", spec, err)
+	}
+	// both 0 and 7 mean sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	// "*", "*/1" and "1-31" are all the same unrestricted field
+	s.domAny = s.dom == cronRange(1, 31)
+	s.dowAny = s.dow&cronRange(0, 6) == cronRange(0, 6)
+	s.hourAny = s.hour == cronRange(0, 23)
+	return s, nil
+}
+
+func cronRange(min, max int) uint64 {
+	return (1<<uint(max+1) - 1) &^ (1<<uint(min) - 1)
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rng, step = part[:i], n
+		}
+		lo, hi := min, max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			i := strings.Index(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(rng[:i]); err != nil {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+			if hi, err = strconv.Atoi(rng[i+1:]); err != nil {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		default:
+			n, err := strconv.Atoi(rng)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", rng)
+			}
+			lo = n
+			if step == 1 {
+				hi = n
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for n := lo; n <= hi; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first matching minute strictly after t, or the zero
+// time if nothing matches within five years, which leaves room for the
+// 29th of February. It steps through absolute time, so wall times that
+// don't exist on a DST change never match, and a job at a fixed hour runs
+// only once in the hour that repeats when clocks go back.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0 || !s.dayMatches(t):
+			next := time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			if !next.After(t) {
+				// midnight falls into a DST gap
+				next = t.Add(time.Minute)
+			}
+			t = next
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		case !s.hourAny && repeatedWallTime(t):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// repeatedWallTime reports whether the clock already showed the
+// hour and minute of t, before it was set back.
+func repeatedWallTime(t time.Time) bool {
+	_, off := t.Zone()
+	_, before := t.Add(-3 * time.Hour).Zone()
+	if before <= off {
+		return false
+	}
+	e := t.Add(-time.Duration(before-off) * time.Second)
+	return e.Hour() == t.Hour() && e.Minute() == t.Minute()
+}
+
+func (s *Schedule) String() string {
+	return s.Spec
+}
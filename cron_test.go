@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseSchedule(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded", spec)
+		}
+	}
+	for _, spec := range []string{"@hourly", "@daily", "0 */4 * * *", "30 9 * * 1-5", "0,30 8-18/2 1,15 * 7"} {
+		if _, err := ParseSchedule(spec); err != nil {
+			t.Errorf("ParseSchedule(%q): %v", spec, err)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	est := time.FixedZone("EST", -5*3600)
+	edt := time.FixedZone("EDT", -4*3600)
+	tests := []struct {
+		spec      string
+		from, out time.Time
+	}{
+		{"*/15 * * * *", time.Date(2026, 6, 1, 10, 7, 30, 0, time.UTC), time.Date(2026, 6, 1, 10, 15, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 6, 1, 10, 15, 0, 0, time.UTC), time.Date(2026, 6, 1, 10, 30, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2026, 6, 5, 10, 0, 0, 0, time.UTC), time.Date(2026, 6, 8, 9, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2026, 12, 15, 0, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 6, 7, 0, 0, 0, 0, time.UTC)},
+		// either day field matches when both are restricted
+		{"0 0 13 * 5", time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 6, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2026, 6, 12, 1, 0, 0, 0, time.UTC), time.Date(2026, 6, 13, 0, 0, 0, 0, time.UTC)},
+		// full ranges are the same as "*"
+		{"0 0 1-31 * 1", time.Date(2026, 6, 2, 0, 0, 0, 0, time.UTC), time.Date(2026, 6, 8, 0, 0, 0, 0, time.UTC)},
+		{"0 0 */1 * 1", time.Date(2026, 6, 2, 0, 0, 0, 0, time.UTC), time.Date(2026, 6, 8, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 0-6", time.Date(2026, 6, 2, 0, 0, 0, 0, time.UTC), time.Date(2026, 6, 13, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), time.Time{}},
+
+		// spring forward, 02:00 EST is 03:00 EDT
+		{"30 2 * * *", time.Date(2026, 3, 8, 0, 0, 0, 0, ny), time.Date(2026, 3, 9, 2, 30, 0, 0, ny)},
+		{"*/30 * * * *", time.Date(2026, 3, 8, 1, 45, 0, 0, ny), time.Date(2026, 3, 8, 3, 0, 0, 0, ny)},
+		{"0 * * * *", time.Date(2026, 3, 8, 1, 0, 0, 0, ny), time.Date(2026, 3, 8, 3, 0, 0, 0, ny)},
+		// fall back, 02:00 EDT is 01:00 EST
+		{"*/15 * * * *", time.Date(2026, 11, 1, 1, 20, 0, 0, est).In(ny), time.Date(2026, 11, 1, 1, 30, 0, 0, est)},
+		{"*/15 * * * *", time.Date(2026, 11, 1, 1, 50, 0, 0, edt).In(ny), time.Date(2026, 11, 1, 1, 0, 0, 0, est)},
+		{"0 * * * *", time.Date(2026, 11, 1, 1, 0, 0, 0, edt).In(ny), time.Date(2026, 11, 1, 1, 0, 0, 0, est)},
+		{"30 1 * * *", time.Date(2026, 11, 1, 1, 30, 0, 0, edt).In(ny), time.Date(2026, 11, 2, 1, 30, 0, 0, ny)},
+		{"30 1 * * *", time.Date(2026, 10, 31, 12, 0, 0, 0, ny), time.Date(2026, 11, 1, 1, 30, 0, 0, edt)},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.spec)
+		if err != nil {
+			t.Fatalf("ParseSchedule(%q): %v", tt.spec, err)
+		}
+		got := s.Next(tt.from)
+		if !got.Equal(tt.out) {
+			t.Errorf("%q.Next(%v) = %v, want %v", tt.spec, tt.from, got, tt.out)
+		}
+		if !got.IsZero() && !got.After(tt.from) {
+			t.Errorf("%q.Next(%v) = %v is not after it", tt.spec, tt.from, got)
+		}
+	}
+}
+
+// Every minute across both DST changes of a year, Next must move forward.
+func TestScheduleNextAlwaysAfter(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range []string{"*/15 * * * *", "30 2 * * *", "0 1 * * *", "0 0 * * *"} {
+		s, err := ParseSchedule(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, day := range []time.Time{time.Date(2026, 3, 7, 20, 0, 0, 0, ny), time.Date(2026, 10, 31, 20, 0, 0, 0, ny)} {
+			for from := day; from.Before(day.Add(12 * time.Hour)); from = from.Add(7 * time.Minute) {
+				if next := s.Next(from); !next.After(from) {
+					t.Fatalf("%q.Next(%v) = %v", spec, from, next)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/LamaLamer/redigram/publish"
+)
+
+type Daemon struct {
+	Jitter       time.Duration
+	CollectEvery time.Duration
+	WatchEvery   time.Duration
+	Status       io.Writer
+
+	jobs     []*job
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	statusMu sync.Mutex
+}
+
+type job struct {
+	account  *Account
+	schedule *Schedule
+
+	// runMu keeps posting, metric collection and takedowns of an account apart
+	runMu sync.Mutex
+
+	mu      sync.Mutex
+	running bool
+	stopped bool
+	halted  chan struct{} // closed once stopped
+	next    time.Time
+	last    time.Time
+	lastErr error
+}
+
+func NewDaemon(accounts []*Account, jitter time.Duration) (*Daemon, error) {
+	d := &Daemon{
+		Jitter: jitter,
+		Status: os.Stdout,
+		stop:   make(chan struct{}),
+	}
+	for _, a := range accounts {
+		s, err := ParseSchedule(a.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("account %s: %v", a.Name, err)
+		}
+		d.jobs = append(d.jobs, &job{account: a, schedule: s, halted: make(chan struct{})})
+	}
+	if len(d.jobs) == 0 {
+		return nil, fmt.Errorf("no accounts to schedule")
+	}
+	return d, nil
+}
+
+// RunDaemon schedules the accounts until ctx ends, then waits for the
+// runs in progress. Posting runs are not canceled with ctx, metric
+// collection and takedown checks are.
+func RunDaemon(ctx context.Context, accounts []*Account) error {
+	d, err := NewDaemon(accounts, settings.Jitter.Duration)
+	if err != nil {
+		return err
+	}
+	d.CollectEvery = settings.CollectEvery.Duration
+	d.WatchEvery = settings.WatchEvery.Duration
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	d.Start(ctx)
+	for ctx.Err() == nil {
+		select {
+		case <-sigs:
+			d.WriteStatus()
+		case <-ctx.Done():
+		}
+	}
+	log.Printf("daemon: stopping, waiting for running jobs")
+	d.Shutdown()
+	return nil
+}
+
+// Start schedules every job. ctx is passed to metric collection and
+// takedown checks, posting runs always finish.
+func (d *Daemon) Start(ctx context.Context) {
+	for _, j := range d.jobs {
+		j.reschedule(time.Now(), d.Jitter)
+	}
+	d.WriteStatus()
+	for _, j := range d.jobs {
+		d.wg.Add(1)
+		go d.loop(j)
+		if d.CollectEvery > 0 {
+			d.wg.Add(1)
+			go d.everyLoop(ctx, j, "collect", d.CollectEvery, Collect)
+		}
+		if d.WatchEvery > 0 {
+			d.wg.Add(1)
+			go d.everyLoop(ctx, j, "watch", d.WatchEvery, Watch)
+		}
+	}
+}
+
+// Shutdown stops scheduling new runs and blocks until
+// the ones already in progress are done.
+func (d *Daemon) Shutdown() {
+	close(d.stop)
+	d.wg.Wait()
+}
+
+func (d *Daemon) loop(j *job) {
+	defer d.wg.Done()
+	for {
+		next := j.nextRun()
+		if next.IsZero() {
+			log.Printf("daemon: %s: schedule %s never fires", j.account, j.schedule)
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-d.stop:
+			timer.Stop()
+			return
+		case <-j.halted:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := d.run(j); publish.ClassifyError(err) == publish.ErrCheckpoint {
+			d.halt(j)
+		}
+		if j.isStopped() {
+			return
+		}
+		// runs are sequential per job, so a slow run simply
+		// skips the slots it overlapped instead of piling up.
+		j.reschedule(time.Now(), d.Jitter)
+		d.WriteStatus()
+	}
+}
+
+// everyLoop runs f for the account of j every interval, next to its
+// posting schedule. A checkpoint stops the whole job like in loop.
+func (d *Daemon) everyLoop(ctx context.Context, j *job, name string, every time.Duration, f func(context.Context, *Account) error) {
+	defer d.wg.Done()
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-j.halted:
+			return
+		case <-ticker.C:
+		}
+		j.runMu.Lock()
+		if j.isStopped() {
+			j.runMu.Unlock()
+			return
+		}
+		err := f(ctx, j.account)
+		j.runMu.Unlock()
+		if err == nil {
+			continue
+		}
+		log.Printf("daemon: %s: %s: %v", j.account, name, err)
+		if publish.ClassifyError(err) == publish.ErrCheckpoint {
+			j.mu.Lock()
+			j.lastErr = fmt.Errorf("%s: %v", name, err)
+			j.mu.Unlock()
+			d.halt(j)
+			return
+		}
+	}
+}
+
+// halt stops every loop of j, the account needs the checkpoint
+// resolved and the daemon restarted.
+func (d *Daemon) halt(j *job) {
+	j.mu.Lock()
+	if !j.stopped {
+		j.stopped = true
+		j.next = time.Time{}
+		close(j.halted)
+	}
+	j.mu.Unlock()
+	log.Printf("daemon: %s: stopped until the checkpoint is resolved", j.account)
+	d.WriteStatus()
+}
+
+func (j *job) isStopped() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.stopped
+}
+
+func (d *Daemon) run(j *job) error {
+	j.runMu.Lock()
+	defer j.runMu.Unlock()
+	if j.isStopped() {
+		return nil
+	}
+	j.mu.Lock()
+	j.running = true
+	j.mu.Unlock()
+	log.Printf("daemon: %s: starting run", j.account)
+	err := DoPost(context.Background(), j.account)
+	if err != nil {
+		log.Printf("daemon: %s: %v", j.account, err)
+	}
+	j.mu.Lock()
+	j.running = false
+	j.last = time.Now()
+	j.lastErr = err
+	j.mu.Unlock()
+	return err
+}
+
+func (j *job) reschedule(now time.Time, jitter time.Duration) {
+	next := j.schedule.Next(now)
+	if !next.IsZero() && jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(jitter))))
+	}
+	j.mu.Lock()
+	j.next = next
+	j.mu.Unlock()
+}
+
+func (j *job) nextRun() time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.next
+}
+
+func (d *Daemon) WriteStatus() {
+	d.statusMu.Lock()
+	defer d.statusMu.Unlock()
+	w := tabwriter.NewWriter(d.Status, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tSCHEDULE\tSTATE\tNEXT RUN\tLAST RUN\tLAST ERROR")
+	for _, j := range d.jobs {
+		j.mu.Lock()
+		state := "idle"
+		switch {
+		case j.running:
+			state = "running"
+		case j.stopped:
+			state = "stopped"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			j.account, j.schedule, state, fmtTime(j.next), fmtTime(j.last), fmtErr(j.lastErr))
+		j.mu.Unlock()
+	}
+	w.Flush()
+}
+
+func fmtTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func fmtErr(err error) string {
+	if err == nil {
+		return "-"
+	}
+	return err.Error()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/LamaLamer/redigram/fakeinsta"
+	"github.com/LamaLamer/redigram/publish"
+	"github.com/LamaLamer/redigram/store"
+)
+
+// newCollectEnv is a test env with one published post due for metrics,
+// so every collection logs in.
+func newCollectEnv(t *testing.T) (*testEnv, *Daemon) {
+	e := newTestEnv(t)
+	e.a.Schedule = "0 0 1 1 *"
+	err := e.st.Insert(&store.Record{
+		ID:      "post1",
+		Posted:  time.Now().Add(-2 * time.Hour),
+		Results: []*publish.Result{{Publisher: "instagram", ID: "1_1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDaemon([]*Account{e.a}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.CollectEvery = 10 * time.Millisecond
+	d.Status = &bytes.Buffer{}
+	return e, d
+}
+
+func TestDaemonCollectCheckpoint(t *testing.T) {
+	e, d := newCollectEnv(t)
+	e.insta.Fail("accounts/login/", fakeinsta.Checkpoint)
+	d.Start(context.Background())
+	defer d.Shutdown()
+	j := d.jobs[0]
+	select {
+	case <-j.halted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the checkpoint did not stop the job")
+	}
+	if !j.nextRun().IsZero() || j.lastErr == nil {
+		t.Errorf("next run %v, last error %v", j.nextRun(), j.lastErr)
+	}
+	// nothing logs in again
+	time.Sleep(50 * time.Millisecond)
+	if n := e.count("accounts/login/"); n != 1 {
+		t.Errorf("%d logins after the checkpoint", n)
+	}
+}
+
+func TestDaemonShutdownCancelsCollect(t *testing.T) {
+	e, d := newCollectEnv(t)
+	e.insta.Fail("accounts/login/", fakeinsta.Fault{Delay: 2 * time.Second})
+	ctx, cancel := context.WithCancel(context.Background())
+	d.Start(ctx)
+	for e.count("accounts/login/") == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		d.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown waited for the collection")
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/LamaLamer/redigram/store"
+)
+
+// Dashboard is the review UI served by the serve command.
+// It works on the same store as the bot, so decisions made
+// here are picked up by the next scheduled run.
+type Dashboard struct {
+	Account *Account
+	// Addr is the address the dashboard listens on. Requests must be
+	// for it, or for a loopback name with its port when it listens
+	// on a loopback or unspecified address.
+	Addr string
+
+	st *store.Store
+}
+
+func NewDashboard(a *Account, addr string) *Dashboard {
+	return &Dashboard{Account: a, Addr: addr, st: store.New(a.Store)}
+}
+
+func RunServe(ctx context.Context, a *Account, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: NewDashboard(a, addr).Handler()}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	log.Printf("dashboard for %s on http://%s/", a, addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (d *Dashboard) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.serveQueue)
+	mux.HandleFunc("/image/", d.serveImage)
+	mux.HandleFunc("/queue/", d.serveDecision)
+	mux.HandleFunc("/history", d.serveHistory)
+	mux.HandleFunc("/rejected", d.serveRejected)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a page of another site whose name was rebound
+		// to this machine comes with its own host
+		if !d.allowedHost(r.Host) {
+			http.Error(w, "unknown host", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// allowedHost reports whether host, from the Host header,
+// names the address the dashboard listens on.
+func (d *Dashboard) allowedHost(host string) bool {
+	if host == d.Addr {
+		return true
+	}
+	h, port, err := net.SplitHostPort(d.Addr)
+	if err != nil {
+		return false
+	}
+	if ip := net.ParseIP(h); h != "localhost" && (ip == nil || !ip.IsLoopback() && !ip.IsUnspecified()) {
+		return false
+	}
+	for _, name := range []string{"localhost", "127.0.0.1", "::1"} {
+		if host == net.JoinHostPort(name, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Dashboard) serveQueue(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	q, err := LoadQueue(d.st)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var entries []*QueueEntry
+	for _, e := range q.Entries {
+		if e.Status != QueueRejected {
+			entries = append(entries, e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Prepared.Before(entries[j].Prepared)
+	})
+	d.render(w, "queue", entries)
+}
+
+func (d *Dashboard) serveImage(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/image/")
+	data, err := d.st.GetStateData(queueImageKey(id))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write(data)
+}
+
+// serveDecision handles the approve, reject and caption forms of the queue.
+func (d *Dashboard) serveDecision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross origin request", http.StatusForbidden)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/queue/")
+	action := r.FormValue("action")
+	switch action {
+	case "approve", "reject", "caption":
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	// the bot and other commands change the queue too,
+	// so it is reloaded and only this entry is changed
+	var derr error
+	err := UpdateQueue(d.st, func(q *Queue) error {
+		switch action {
+		case "approve":
+			derr = q.Decide(d.st, id, QueueApproved, "")
+		case "reject":
+			derr = q.Decide(d.st, id, QueueRejected, strings.TrimSpace(r.FormValue("reason")))
+		case "caption":
+			derr = q.SetCaption(id, r.FormValue("caption"))
+		}
+		return derr
+	})
+	switch {
+	case derr != nil:
+		http.Error(w, derr.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// sameOrigin rejects form posts from other sites to the local dashboard.
+// Browsers send Origin or at least Referer with form posts, requests
+// with neither are not taken from the dashboard.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func (d *Dashboard) serveHistory(w http.ResponseWriter, r *http.Request) {
+	rr, err := d.st.Records()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d.render(w, "history", rr)
+}
+
+func (d *Dashboard) serveRejected(w http.ResponseWriter, r *http.Request) {
+	q, err := LoadQueue(d.st)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Sub      string
+		Queue    []*QueueEntry
+		Listing  []Verdict
+		FetchErr error
+	}{Sub: d.Account.Sub}
+	for _, e := range q.Entries {
+		if e.Status == QueueRejected {
+			data.Queue = append(data.Queue, e)
+		}
+	}
+	vv, err := EvaluateListing(r.Context(), d.Account, d.st, d.Account.Sub)
+	data.FetchErr = err
+	for _, v := range vv {
+		if !v.Passed() {
+			data.Listing = append(data.Listing, v)
+		}
+	}
+	d.render(w, "rejected", data)
+}
+
+func (d *Dashboard) render(w http.ResponseWriter, name string, data interface{}) {
+	err := dashboardTemplates.ExecuteTemplate(w, name, struct {
+		Account *Account
+		Data    interface{}
+	}{d.Account, data})
+	if err != nil {
+		log.Printf("dashboard: %s: %v", name, err)
+	}
+}
+
+var dashboardTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"latest": func(r *store.Record) *store.Metric { return r.MetricAt("latest") },
+	"code": func(r *store.Record) string {
+		for _, res := range r.Results {
+			if res.Publisher == "instagram" && res.Code != "" {
+				return res.Code
+			}
+		}
+		return ""
+	},
+}).Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>redigram {{.Account}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; color: #222; }
+nav a { margin-right: 1em; }
+.grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(280px, 1fr)); gap: 1em; }
+.card { border: 1px solid #ccc; border-radius: 4px; padding: .5em; }
+.card img { width: 100%; }
+.approved { border-color: #2a2; background: #f3fff3; }
+textarea { width: 100%; box-sizing: border-box; }
+table { border-collapse: collapse; }
+td, th { border-bottom: 1px solid #ddd; padding: .3em .6em; text-align: left; }
+.muted { color: #888; }
+</style></head><body>
+<nav><b>{{.Account}}</b> <a href="/">Queue</a><a href="/history">History</a><a href="/rejected">Rejected</a></nav>
+{{end}}
+
+{{define "foot"}}</body></html>{{end}}
+
+{{define "queue"}}{{template "head" .}}
+<h2>Queue</h2>
+{{if not .Data}}<p class="muted">Nothing queued, run the prepare command.</p>{{end}}
+<div class="grid">
+{{range .Data}}
+<div class="card {{.Status}}">
+<img src="/image/{{.ID}}" alt="">
+<p><a href="https://reddit.com{{.Submission.Permalink}}">{{.Submission.Title}}</a><br>
+<span class="muted">r/{{.Submission.Subreddit}} · u/{{.Submission.Author}} · {{.Submission.Score}} points · {{.Status}}</span></p>
+<form method="post" action="/queue/{{.ID}}">
+<textarea name="caption" rows="3">{{.Caption}}</textarea>
+<button name="action" value="caption">Save caption</button>
+<button name="action" value="approve">Approve</button>
+<input name="reason" placeholder="reason to reject (optional)">
+<button name="action" value="reject">Reject</button>
+</form>
+</div>
+{{end}}
+</div>
+{{template "foot"}}{{end}}
+
+{{define "history"}}{{template "head" .}}
+<h2>History</h2>
+<table>
+<tr><th>Posted</th><th>Sub</th><th>Title</th><th>Caption</th><th>Status</th><th>Instagram</th><th>Likes</th><th>Comments</th></tr>
+{{range .Data}}
+<tr>
+<td>{{if not .Posted.IsZero}}{{.Posted.Format "2006-01-02 15:04"}}{{end}}</td>
+<td>{{if .Subreddit}}r/{{.Subreddit}}{{end}}</td>
+<td><a href="https://redd.it/{{.ID}}">{{.Title}}</a></td>
+<td>{{.Caption}}</td>
+<td>{{if .Dry}}dry{{else if .Status}}{{.Status}}{{else}}posted{{end}}{{if .Takedown}}: {{.Takedown.Reason}}{{end}}{{if .Error}}: {{.Error}}{{end}}</td>
+<td>{{with code .}}<a href="https://www.instagram.com/p/{{.}}/">{{.}}</a>{{end}}</td>
+{{with latest .}}<td>{{.Likes}}</td><td>{{.Comments}}</td>{{else}}<td></td><td></td>{{end}}
+</tr>
+{{end}}
+</table>
+{{template "foot"}}{{end}}
+
+{{define "rejected"}}{{template "head" .}}
+<h2>Rejected in the queue</h2>
+<table>
+<tr><th>Decided</th><th>Title</th><th>Caption</th><th>Reason</th></tr>
+{{range .Data.Queue}}
+<tr><td>{{.Decided.Format "2006-01-02 15:04"}}</td><td><a href="https://reddit.com{{.Submission.Permalink}}">{{.Submission.Title}}</a></td><td>{{.Caption}}</td><td>{{.Reason}}</td></tr>
+{{end}}
+</table>
+<h2>Rejected from r/{{.Data.Sub}} right now</h2>
+{{with .Data.FetchErr}}<p>Could not fetch the listing: {{.}}</p>{{end}}
+<table>
+<tr><th>Score</th><th>Rule</th><th>Reason</th><th>Title</th></tr>
+{{range .Data.Listing}}
+<tr><td>{{.Submission.Score}}</td><td>{{.Rule}}</td><td>{{.Reason}}</td><td><a href="https://reddit.com{{.Submission.Permalink}}">{{.Submission.Title}}</a></td></tr>
+{{end}}
+</table>
+{{template "foot"}}{{end}}
+`))
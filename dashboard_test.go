@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LamaLamer/redigram/store"
+)
+
+// newDashboardServer serves the dashboard of a on a local port.
+func newDashboardServer(t *testing.T, a *Account) *httptest.Server {
+	d := NewDashboard(a, "")
+	srv := httptest.NewServer(d.Handler())
+	t.Cleanup(srv.Close)
+	d.Addr = srv.Listener.Addr().String()
+	return srv
+}
+
+// postDecision posts form to target the way a page from origin would.
+func postDecision(origin, target string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", origin)
+	return http.DefaultClient.Do(req)
+}
+
+// Decisions from the dashboard and from queue commands of other
+// processes on the same store all end up in the queue.
+func TestDashboardDecisions(t *testing.T) {
+	a := DefaultAccount()
+	a.Store = t.TempDir()
+	st := store.New(a.Store)
+	const n = 10
+	err := UpdateQueue(st, func(q *Queue) error {
+		for i := 0; i < 2*n; i++ {
+			q.Entries = append(q.Entries, &QueueEntry{ID: fmt.Sprint("p", i), Status: QueuePending, Prepared: time.Now()})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newDashboardServer(t, a)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := postDecision(srv.URL, srv.URL+fmt.Sprint("/queue/p", i), url.Values{"action": {"reject"}})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("reject p%d: %s", i, resp.Status)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			if err := RunQueue(a, "approve", []string{fmt.Sprint("p", n+i)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	q, err := LoadQueue(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range q.Entries {
+		want := QueueRejected
+		if i >= n {
+			want = QueueApproved
+		}
+		if e.Status != want {
+			t.Errorf("%s is %s, want %s", e.ID, e.Status, want)
+		}
+	}
+}
+
+func TestDashboardBadDecision(t *testing.T) {
+	a := DefaultAccount()
+	a.Store = t.TempDir()
+	srv := newDashboardServer(t, a)
+	for _, form := range []url.Values{{"action": {"approve"}}, {"action": {"publish"}}} {
+		resp, err := postDecision(srv.URL, srv.URL+"/queue/nope", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: %s", form, resp.Status)
+		}
+	}
+}
+
+// Only form posts from the dashboard itself, to the address it
+// listens on, are taken.
+func TestDashboardForeignRequests(t *testing.T) {
+	a := DefaultAccount()
+	a.Store = t.TempDir()
+	err := UpdateQueue(store.New(a.Store), func(q *Queue) error {
+		q.Entries = append(q.Entries, &QueueEntry{ID: "p", Status: QueuePending, Prepared: time.Now()})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newDashboardServer(t, a)
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	approve := url.Values{"action": {"approve"}}
+	tests := []struct {
+		name   string
+		origin string
+		host   string // "" for the address of the server
+		status int
+	}{
+		{"no origin", "", "", http.StatusForbidden},
+		{"other site", "http://evil.example", "", http.StatusForbidden},
+		{"rebound name", "http://evil.example", fmt.Sprintf("evil.example:%d", port), http.StatusForbidden},
+		{"rebound name with its origin", fmt.Sprintf("http://evil.example:%d", port), fmt.Sprintf("evil.example:%d", port), http.StatusForbidden},
+		{"localhost", fmt.Sprintf("http://localhost:%d", port), fmt.Sprintf("localhost:%d", port), http.StatusOK},
+		{"dashboard", srv.URL, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("POST", srv.URL+"/queue/p", strings.NewReader(approve.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.host != "" {
+			req.Host = tt.host
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: %s, want %d", tt.name, resp.Status, tt.status)
+		}
+	}
+}
+
+// The reason given for a rejection is kept and shown with the rejected posts.
+func TestDashboardRejectReason(t *testing.T) {
+	a := DefaultAccount()
+	a.Store = t.TempDir()
+	st := store.New(a.Store)
+	err := UpdateQueue(st, func(q *Queue) error {
+		q.Entries = append(q.Entries, &QueueEntry{ID: "p", Status: QueuePending, Prepared: time.Now()})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newDashboardServer(t, a)
+	resp, err := postDecision(srv.URL, srv.URL+"/queue/p", url.Values{"action": {"reject"}, "reason": {" blurry "}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	q, err := LoadQueue(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := q.Get("p")
+	if e.Status != QueueRejected || e.Reason != "blurry" {
+		t.Fatalf("entry %+v", e)
+	}
+	var buf strings.Builder
+	err = dashboardTemplates.ExecuteTemplate(&buf, "rejected", map[string]interface{}{
+		"Account": a,
+		"Data":    map[string]interface{}{"Sub": a.Sub, "Queue": q.Entries},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "<td>blurry</td>") {
+		t.Errorf("the reason is not shown:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/LamaLamer/redigram/photo"
+	"github.com/LamaLamer/redigram/pipeline"
+	"github.com/LamaLamer/redigram/publish"
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
+)
+
+// Manifest describes the output of a dry run for review.
+type Manifest struct {
+	Generated  time.Time            `json:"generated"`
+	Account    string               `json:"account"`
+	Subreddit  string               `json:"subreddit"`
+	Ranking    []RankingConfig      `json:"ranking"`
+	Candidates []*ManifestCandidate `json:"candidates"`
+	Rejected   []*ManifestRejection `json:"rejected"`
+}
+
+type ManifestCandidate struct {
+	Rank    int                `json:"rank"`
+	File    string             `json:"file"`
+	Caption string             `json:"caption"`
+	Width   int                `json:"width"`
+	Height  int                `json:"height"`
+	Total   float64            `json:"ranking_score"`
+	Parts   map[string]float64 `json:"ranking_parts"`
+	Filter  string             `json:"filter"`
+	Source  ManifestSource     `json:"source"`
+}
+
+type ManifestRejection struct {
+	Rule   string         `json:"rule"`
+	Reason string         `json:"reason"`
+	Source ManifestSource `json:"source"`
+}
+
+type ManifestSource struct {
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Subreddit   string    `json:"subreddit"`
+	Author      string    `json:"author"`
+	Score       int       `json:"score"`
+	NumComments int       `json:"num_comments"`
+	Created     time.Time `json:"created"`
+	Flair       string    `json:"flair,omitempty"`
+	URL         string    `json:"url"`
+	Permalink   string    `json:"permalink"`
+}
+
+func manifestSource(s reddit.Submission) ManifestSource {
+	return ManifestSource{
+		ID:          s.ID,
+		Title:       s.Title,
+		Subreddit:   s.Subreddit,
+		Author:      s.Author,
+		Score:       s.Score,
+		NumComments: s.NumComments,
+		Created:     s.CreatedTime(),
+		Flair:       s.LinkFlairText,
+		URL:         s.URL,
+		Permalink:   "https://reddit.com" + s.Permalink,
+	}
+}
+
+// DryRun renders the top -top candidates of sub into -out next to
+// a manifest.json, without recording posts or touching any publisher.
+func DryRun(ctx context.Context, a *Account, st *store.Store, sub string) error {
+	vv, err := EvaluateListing(ctx, a, st, sub)
+	if err != nil {
+		return err
+	}
+	m := &Manifest{
+		Generated: time.Now(),
+		Account:   a.Name,
+		Subreddit: sub,
+		Ranking:   a.Ranking,
+	}
+	var ss []reddit.Submission
+	for _, v := range vv {
+		if v.Passed() {
+			ss = append(ss, v.Submission)
+			continue
+		}
+		m.Rejected = append(m.Rejected, &ManifestRejection{
+			Rule:   v.Rule,
+			Reason: v.Reason,
+			Source: manifestSource(v.Submission),
+		})
+	}
+	rs, err := NewRankers(a, st)
+	if err != nil {
+		return err
+	}
+	ranked := Rank(rs, ss, time.Now())
+	if err := WriteRanking(os.Stdout, rs, ranked); err != nil {
+		return err
+	}
+	var images []Ranked
+	for _, rk := range ranked {
+		if photo.IsImageURL(rk.Submission.URL) {
+			images = append(images, rk)
+			continue
+		}
+		m.Rejected = append(m.Rejected, &ManifestRejection{
+			Rule:   "image",
+			Reason: "not an image link",
+			Source: manifestSource(rk.Submission),
+		})
+	}
+	pl := newPipeline(a, st)
+	for len(images) > 0 && len(m.Candidates) < settings.Top {
+		batch := images[:pl.Batch(len(images))]
+		images = images[len(batch):]
+		ss := make([]reddit.Submission, len(batch))
+		for i, rk := range batch {
+			ss[i] = rk.Submission
+		}
+		pp, err := pl.PrefetchImages(ctx, ss)
+		if err != nil {
+			return err
+		}
+		for i, pf := range pp {
+			if len(m.Candidates) >= settings.Top {
+				break
+			}
+			rk := batch[i]
+			p, err := pl.Post(ctx, pf)
+			if err != nil {
+				log.Printf("%s: %v", rk.Submission.ID, err)
+				rule, reason := "image", err.Error()
+				if ie, ok := err.(*pipeline.ImageError); ok {
+					rule, reason = ie.Rule, ie.Reason
+				}
+				m.Rejected = append(m.Rejected, &ManifestRejection{
+					Rule:   rule,
+					Reason: reason,
+					Source: manifestSource(rk.Submission),
+				})
+				continue
+			}
+			fmt.Println(p)
+			file, err := SavePost(settings.Out, p)
+			if err != nil {
+				return err
+			}
+			parts := map[string]float64{}
+			for j, r := range rs {
+				parts[r.Name()] = rk.Parts[j]
+			}
+			m.Candidates = append(m.Candidates, &ManifestCandidate{
+				Rank:    len(m.Candidates) + 1,
+				File:    filepath.Base(file),
+				Caption: p.Caption,
+				Width:   pf.Width,
+				Height:  pf.Height,
+				Total:   rk.Total,
+				Parts:   parts,
+				Filter:  "passed",
+				Source:  manifestSource(rk.Submission),
+			})
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(settings.Out, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(settings.Out, "manifest.json")
+	fmt.Printf("writing %s\n", path)
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// SavePost writes the image exactly as publishers would upload it
+// and returns the file name.
+func SavePost(dir string, p *publish.Post) (string, error) {
+	data, err := photo.EncodeJPEG(p.Image)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, p.Submission.ID+".jpeg")
+	fmt.Printf("writing to %s\n", path)
+	return path, ioutil.WriteFile(path, data, 0644)
+}
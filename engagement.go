@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/LamaLamer/redigram/store"
+	"github.com/ahmdrz/goinsta"
+)
+
+// Collect refreshes the engagement metrics of every post of the
+// account that reached a new checkpoint.
+func Collect(ctx context.Context, a *Account) error {
+	st := store.New(a.Store)
+	rr, err := st.Records()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	due := map[string]*store.Record{}
+	var oldest time.Time
+	for _, r := range rr {
+		id := r.InstagramID()
+		if id == "" || r.DueCheckpoint(now) == "" {
+			continue
+		}
+		due[id] = r
+		if oldest.IsZero() || r.Posted.Before(oldest) {
+			oldest = r.Posted
+		}
+	}
+	if len(due) == 0 {
+		return nil
+	}
+	insta, err := a.Instagram().Login(ctx)
+	if err != nil {
+		return err
+	}
+	defer insta.Logout()
+	followers := insta.Account.FollowerCount
+	feed := insta.Account.Feed()
+	// every sample is stored as it is taken, so stopping early loses nothing
+	for len(due) > 0 && ctx.Err() == nil && feed.Next() {
+		done := false
+		for _, item := range feed.Items {
+			taken := time.Unix(int64(item.TakenAt), 0)
+			if taken.Before(oldest.Add(-24 * time.Hour)) {
+				done = true
+			}
+			r, ok := due[item.ID]
+			if !ok {
+				continue
+			}
+			delete(due, item.ID)
+			r.Metrics = append(r.Metrics, &store.Metric{
+				Checkpoint: r.DueCheckpoint(now),
+				Time:       now,
+				Likes:      item.Likes,
+				Comments:   item.CommentCount,
+				Followers:  followers,
+			})
+			if err := st.Insert(r); err != nil {
+				return err
+			}
+		}
+		if done {
+			break
+		}
+	}
+	if err := feed.Error(); err != nil && err != goinsta.ErrNoMore {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return nil
+}
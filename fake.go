@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/LamaLamer/redigram/fakeinsta"
+)
+
+// RunFakeInstagram serves the fake Instagram API until interrupted,
+// so full runs can be tried without touching a real account.
+func RunFakeInstagram(ctx context.Context) error {
+	srv := fakeinsta.NewServer()
+	defer srv.Close()
+	fmt.Printf("fake instagram listening, run with -instaproxy %s\n", srv.ProxyURL())
+	<-ctx.Done()
+	for _, m := range srv.Media() {
+		if m.Deleted {
+			fmt.Printf("%s %s %q (deleted)\n", m.ID, m.Code, m.Caption)
+			continue
+		}
+		fmt.Printf("%s %s %q\n", m.ID, m.Code, m.Caption)
+	}
+	return nil
+}
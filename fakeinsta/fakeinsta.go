@@ -0,0 +1,469 @@
+// Package fakeinsta is an in-process stand-in for the subset of the
+// Instagram private API that goinsta uses: login, the current user,
+// photo upload, configure, comments, media info/delete and the user feed.
+//
+// goinsta talks to a hardcoded https://i.instagram.com, so the server
+// is reached through an HTTP CONNECT proxy that tunnels every request
+// to a TLS test server. Point goinsta at it with
+//
+//	insta.SetProxy(srv.ProxyURL(), true)
+//
+// Failures are scripted per endpoint with Fail. Like on Instagram, a
+// checkpoint sticks: once served, every request gets it until Resolve.
+package fakeinsta
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	UserID    = 1000
+	Followers = 5000
+)
+
+// Fault is a canned error response. A Fault with only a Delay holds
+// the request that long and then serves it as usual, to interrupt
+// a client in the middle of a request.
+type Fault struct {
+	Status int
+	Body   string
+	Delay  time.Duration
+}
+
+var (
+	Checkpoint       = Fault{Status: 400, Body: `{"message":"challenge_required","challenge":{"url":"https://i.instagram.com/challenge/"},"status":"fail","error_type":"checkpoint_challenge_required"}`}
+	FeedbackRequired = Fault{Status: 400, Body: `{"message":"feedback_required","spam":true,"feedback_title":"Action Blocked","status":"fail"}`}
+	BadPassword      = Fault{Status: 400, Body: `{"message":"The password you entered is incorrect.","invalid_credentials":true,"error_type":"bad_password","status":"fail"}`}
+	BadRequest       = Fault{Status: 400, Body: `{"message":"media_needs_reupload","status":"fail","error_type":"media_error"}`}
+	RateLimited      = Fault{Status: 429, Body: `{"message":"Please wait a few minutes before you try again.","status":"fail"}`}
+	Unavailable      = Fault{Status: 503, Body: `<html>503 Service Unavailable</html>`}
+)
+
+type Comment struct {
+	ID   int64
+	Text string
+	Time time.Time
+}
+
+type Media struct {
+	Pk       int64
+	ID       string
+	Code     string
+	Caption  string
+	Image    []byte
+	Likes    int
+	Comments []Comment
+	TakenAt  time.Time
+	Deleted  bool
+}
+
+type Server struct {
+	// Username and Password are the accepted credentials,
+	// any credentials are accepted when Username is empty.
+	Username string
+	Password string
+
+	api   *httptest.Server
+	proxy *httptest.Server
+
+	mu         sync.Mutex
+	faults     map[string][]Fault
+	checkpoint bool
+	requests   []string
+	uploads    map[string][]byte
+	media      []*Media
+	nextPk     int64
+}
+
+func NewServer() *Server {
+	s := &Server{
+		faults:  map[string][]Fault{},
+		uploads: map[string][]byte{},
+		nextPk:  1,
+	}
+	s.api = httptest.NewTLSServer(http.HandlerFunc(s.serveAPI))
+	s.proxy = httptest.NewServer(http.HandlerFunc(s.serveProxy))
+	return s
+}
+
+func (s *Server) Close() {
+	s.proxy.Close()
+	s.api.Close()
+}
+
+// ProxyURL is the proxy goinsta should be pointed at.
+func (s *Server) ProxyURL() string {
+	return s.proxy.URL
+}
+
+// Fail queues faults for the next requests to endpoint,
+// e.g. "accounts/login/", "upload/photo/" or "media/configure/".
+func (s *Server) Fail(endpoint string, faults ...Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[endpoint] = append(s.faults[endpoint], faults...)
+}
+
+// Resolve clears a checkpoint, as a human confirming the account would.
+func (s *Server) Resolve() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoint = false
+}
+
+// Requests returns the endpoints hit so far, in order.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// Media returns a snapshot of every uploaded media, newest first.
+func (s *Server) Media() []Media {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var mm []Media
+	for i := len(s.media) - 1; i >= 0; i-- {
+		mm = append(mm, *s.media[i])
+	}
+	return mm
+}
+
+// SetLikes changes the like count of a media, to simulate engagement.
+func (s *Server) SetLikes(id string, likes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m := s.find(id); m != nil {
+		m.Likes = likes
+	}
+}
+
+func (s *Server) serveProxy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	upstream, err := net.Dial("tcp", s.api.Listener.Addr().String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+	rw.Flush()
+	go func() {
+		io.Copy(upstream, rw)
+		upstream.Close()
+	}()
+	io.Copy(conn, upstream)
+	conn.Close()
+}
+
+var (
+	reMediaInfo     = regexp.MustCompile(`^media/([^/]+)/info/$`)
+	reMediaDelete   = regexp.MustCompile(`^media/([^/]+)/delete/$`)
+	reCommentAdd    = regexp.MustCompile(`^media/([^/]+)/comment/$`)
+	reCommentDelete = regexp.MustCompile(`^media/([^/]+)/comment/([^/]+)/delete/$`)
+	reComments      = regexp.MustCompile(`^media/([^/]+)/comments/$`)
+	reUserFeed      = regexp.MustCompile(`^feed/user/(\d+)/$`)
+)
+
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request) {
+	endpoint := strings.TrimPrefix(r.URL.Path, "/api/v1/")
+	s.mu.Lock()
+	s.requests = append(s.requests, endpoint)
+	var fault Fault
+	if ff := s.faults[endpoint]; len(ff) > 0 && !s.checkpoint {
+		s.faults[endpoint] = ff[1:]
+		fault = ff[0]
+	}
+	s.mu.Unlock()
+	if fault.Delay > 0 {
+		time.Sleep(fault.Delay)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: "csrftoken", Value: "fakecsrftoken", Path: "/"})
+	if s.checkpoint {
+		writeFault(w, Checkpoint)
+		return
+	}
+	if fault.Status != 0 {
+		s.checkpoint = fault == Checkpoint
+		writeFault(w, fault)
+		return
+	}
+	var m []string
+	match := func(re *regexp.Regexp) bool {
+		m = re.FindStringSubmatch(endpoint)
+		return m != nil
+	}
+	switch {
+	case endpoint == "accounts/login/":
+		s.login(w, r)
+	case endpoint == "accounts/current_user/":
+		writeJSON(w, map[string]interface{}{"user": user(""), "status": "ok"})
+	case endpoint == "upload/photo/":
+		s.uploadPhoto(w, r)
+	case endpoint == "media/configure/":
+		s.configure(w, r)
+	case match(reMediaInfo):
+		s.withMedia(w, m[1], func(media *Media) {
+			writeJSON(w, map[string]interface{}{
+				"items":          []interface{}{s.item(media)},
+				"num_results":    1,
+				"more_available": false,
+				"status":         "ok",
+			})
+		})
+	case match(reMediaDelete):
+		s.withMedia(w, m[1], func(media *Media) {
+			media.Deleted = true
+			writeJSON(w, map[string]interface{}{"did_delete": true, "status": "ok"})
+		})
+	case match(reCommentAdd):
+		s.withMedia(w, m[1], func(media *Media) {
+			c := Comment{ID: s.nextPk, Text: signedBody(r)["comment_text"], Time: time.Now()}
+			s.nextPk++
+			media.Comments = append(media.Comments, c)
+			writeJSON(w, map[string]interface{}{"comment": comment(c), "status": "ok"})
+		})
+	case match(reCommentDelete):
+		s.withMedia(w, m[1], func(media *Media) {
+			for i, c := range media.Comments {
+				if strconv.FormatInt(c.ID, 10) == m[2] {
+					media.Comments = append(media.Comments[:i], media.Comments[i+1:]...)
+					break
+				}
+			}
+			writeJSON(w, map[string]interface{}{"status": "ok"})
+		})
+	case match(reComments):
+		s.withMedia(w, m[1], func(media *Media) {
+			var cc []interface{}
+			for _, c := range media.Comments {
+				cc = append(cc, comment(c))
+			}
+			writeJSON(w, map[string]interface{}{
+				"comments":          cc,
+				"comment_count":     len(cc),
+				"has_more_comments": false,
+				"status":            "ok",
+			})
+		})
+	case match(reUserFeed):
+		var items []interface{}
+		for i := len(s.media) - 1; i >= 0; i-- {
+			if !s.media[i].Deleted {
+				items = append(items, s.item(s.media[i]))
+			}
+		}
+		writeJSON(w, map[string]interface{}{
+			"items":          items,
+			"num_results":    len(items),
+			"more_available": false,
+			"next_max_id":    "",
+			"status":         "ok",
+		})
+	case strings.HasPrefix(endpoint, "/media/"):
+		code := strings.TrimSuffix(strings.TrimPrefix(endpoint, "/media/"), ".jpg")
+		s.withMedia(w, code, func(media *Media) {
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(media.Image)
+		})
+	case endpoint == "accounts/read_msisdn_header/",
+		endpoint == "accounts/contact_point_prefill/",
+		endpoint == "zr/token/result/",
+		endpoint == "attribution/log_attribution/",
+		endpoint == "qe/sync/",
+		endpoint == "accounts/logout/":
+		writeJSON(w, map[string]interface{}{"status": "ok"})
+	default:
+		writeFault(w, Fault{Status: 404, Body: `{"message":"endpoint not supported by fakeinsta","status":"fail"}`})
+	}
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	body := signedBody(r)
+	if s.Username != "" && (body["username"] != s.Username || body["password"] != s.Password) {
+		writeFault(w, BadPassword)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"logged_in_user": user(body["username"]),
+		"status":         "ok",
+	})
+}
+
+func (s *Server) uploadPhoto(w http.ResponseWriter, r *http.Request) {
+	f, _, err := r.FormFile("photo")
+	if err != nil {
+		writeFault(w, Fault{Status: 400, Body: fmt.Sprintf(`{"message":%q,"status":"fail"}`, err)})
+		return
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		writeFault(w, Fault{Status: 400, Body: fmt.Sprintf(`{"message":%q,"status":"fail"}`, err)})
+		return
+	}
+	id := r.FormValue("upload_id")
+	s.uploads[id] = data
+	writeJSON(w, map[string]interface{}{"upload_id": id, "status": "ok"})
+}
+
+func (s *Server) configure(w http.ResponseWriter, r *http.Request) {
+	body := signedBody(r)
+	data, ok := s.uploads[body["upload_id"]]
+	if !ok {
+		writeFault(w, BadRequest)
+		return
+	}
+	delete(s.uploads, body["upload_id"])
+	pk := s.nextPk
+	s.nextPk++
+	media := &Media{
+		Pk:      pk,
+		ID:      fmt.Sprintf("%d_%d", pk, UserID),
+		Code:    fmt.Sprintf("Fk%07d", pk),
+		Caption: body["caption"],
+		Image:   data,
+		TakenAt: time.Now(),
+	}
+	s.media = append(s.media, media)
+	writeJSON(w, map[string]interface{}{
+		"media":     s.item(media),
+		"upload_id": body["upload_id"],
+		"status":    "ok",
+	})
+}
+
+// find looks a media up by id, pk or shortcode.
+func (s *Server) find(id string) *Media {
+	for _, m := range s.media {
+		if m.ID == id || m.Code == id || strconv.FormatInt(m.Pk, 10) == id {
+			return m
+		}
+	}
+	return nil
+}
+
+func (s *Server) withMedia(w http.ResponseWriter, id string, f func(*Media)) {
+	m := s.find(id)
+	if m == nil || m.Deleted {
+		writeFault(w, Fault{Status: 400, Body: `{"message":"Media not found or unavailable","status":"fail"}`})
+		return
+	}
+	f(m)
+}
+
+func (s *Server) item(m *Media) map[string]interface{} {
+	return map[string]interface{}{
+		"pk":            m.Pk,
+		"id":            m.ID,
+		"code":          m.Code,
+		"media_type":    1,
+		"taken_at":      m.TakenAt.Unix(),
+		"like_count":    m.Likes,
+		"comment_count": len(m.Comments),
+		"caption":       map[string]interface{}{"text": m.Caption, "media_id": m.Pk},
+		"user":          user(""),
+		"image_versions2": map[string]interface{}{
+			"candidates": []interface{}{map[string]interface{}{
+				"url":    s.api.URL + "/media/" + m.Code + ".jpg",
+				"width":  1080,
+				"height": 1080,
+			}},
+		},
+	}
+}
+
+func user(username string) map[string]interface{} {
+	if username == "" {
+		username = "fakeinsta"
+	}
+	return map[string]interface{}{
+		"pk":             UserID,
+		"username":       username,
+		"full_name":      "Fake Instagram",
+		"follower_count": Followers,
+	}
+}
+
+func comment(c Comment) map[string]interface{} {
+	return map[string]interface{}{
+		"pk":         c.ID,
+		"text":       c.Text,
+		"created_at": c.Time.Unix(),
+		"user_id":    UserID,
+		"user":       user(""),
+	}
+}
+
+// signedBody decodes the signed_body form value goinsta sends,
+// "<signature>.<json>", into a flat string map.
+func signedBody(r *http.Request) map[string]string {
+	out := map[string]string{}
+	raw, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return out
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(raw))
+	vs, err := url.ParseQuery(string(raw))
+	if err != nil {
+		return out
+	}
+	signed := vs.Get("signed_body")
+	i := strings.Index(signed, ".")
+	if i < 0 {
+		return out
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(signed[i+1:]), &fields); err != nil {
+		return out
+	}
+	for k, v := range fields {
+		switch v := v.(type) {
+		case string:
+			out[k] = v
+		default:
+			b, _ := json.Marshal(v)
+			out[k] = string(b)
+		}
+	}
+	return out
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeFault(w http.ResponseWriter, f Fault) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(f.Status)
+	io.WriteString(w, f.Body)
+}
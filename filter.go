@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
+)
+
+// Rule is a condition over a Submission field. Fields are named by their
+// JSON tag ("over_18", "link_flair_text", ...), plus the computed "age_hours".
+type Rule struct {
+	Name  string      `json:"name"`
+	Field string      `json:"field"`
+	Op    string      `json:"op"` // eq, ne, lt, le, gt, ge, match, in
+	Value interface{} `json:"value"`
+	// Action is "deny" (the default) to reject submissions matching
+	// the condition, or "require" to reject the ones that don't.
+	Action string `json:"action"`
+
+	re *regexp.Regexp
+}
+
+// FilterConfig is the per account content policy. The named options are
+// shorthands that compile into rules, Rules can test any other field.
+type FilterConfig struct {
+	AllowNSFW     bool     `json:"allow_nsfw"`
+	AllowSpoilers bool     `json:"allow_spoilers"`
+	TitleAllow    []string `json:"title_allow"`
+	TitleDeny     []string `json:"title_deny"`
+	AuthorAllow   []string `json:"author_allow"`
+	AuthorDeny    []string `json:"author_deny"`
+	DomainAllow   []string `json:"domain_allow"`
+	DomainDeny    []string `json:"domain_deny"`
+	FlairAllow    []string `json:"flair_allow"`
+	FlairDeny     []string `json:"flair_deny"`
+	MaxAge        Duration `json:"max_age"`
+	MinComments   int      `json:"min_comments"`
+	Rules         []Rule   `json:"rules"`
+
+	// Image rules, checked once the image is downloaded. 0 is no limit,
+	// aspect ratios are width over height.
+	MinWidth  int     `json:"min_width"`
+	MinHeight int     `json:"min_height"`
+	MinAspect float64 `json:"min_aspect"`
+	MaxAspect float64 `json:"max_aspect"`
+	// DuplicateDistance is how many bits the hash of an image may differ
+	// from a posted one and still count as the same, 0 for exact copies.
+	DuplicateDistance int `json:"duplicate_distance"`
+}
+
+func anyRegexp(patterns []string) string {
+	return "(?i)(" + strings.Join(patterns, ")|(") + ")"
+}
+
+func stringList(list []string) []interface{} {
+	var vs []interface{}
+	for _, v := range list {
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+// Compile turns the config into the ordered list of rules to apply.
+func (fc *FilterConfig) Compile() ([]*Rule, error) {
+	var rules []Rule
+	if !fc.AllowNSFW {
+		rules = append(rules, Rule{Name: "nsfw", Field: "over_18", Op: "eq", Value: true})
+	}
+	if !fc.AllowSpoilers {
+		rules = append(rules, Rule{Name: "spoiler", Field: "spoiler", Op: "eq", Value: true})
+	}
+	if len(fc.TitleAllow) > 0 {
+		rules = append(rules, Rule{Name: "title allow", Field: "title", Op: "match", Value: anyRegexp(fc.TitleAllow), Action: "require"})
+	}
+	if len(fc.TitleDeny) > 0 {
+		rules = append(rules, Rule{Name: "title deny", Field: "title", Op: "match", Value: anyRegexp(fc.TitleDeny)})
+	}
+	if len(fc.AuthorAllow) > 0 {
+		rules = append(rules, Rule{Name: "author allow", Field: "author", Op: "in", Value: stringList(fc.AuthorAllow), Action: "require"})
+	}
+	if len(fc.AuthorDeny) > 0 {
+		rules = append(rules, Rule{Name: "author deny", Field: "author", Op: "in", Value: stringList(fc.AuthorDeny)})
+	}
+	if len(fc.DomainAllow) > 0 {
+		rules = append(rules, Rule{Name: "domain allow", Field: "domain", Op: "in", Value: stringList(fc.DomainAllow), Action: "require"})
+	}
+	if len(fc.DomainDeny) > 0 {
+		rules = append(rules, Rule{Name: "domain deny", Field: "domain", Op: "in", Value: stringList(fc.DomainDeny)})
+	}
+	if len(fc.FlairAllow) > 0 {
+		rules = append(rules, Rule{Name: "flair allow", Field: "link_flair_text", Op: "match", Value: anyRegexp(fc.FlairAllow), Action: "require"})
+	}
+	if len(fc.FlairDeny) > 0 {
+		rules = append(rules, Rule{Name: "flair deny", Field: "link_flair_text", Op: "match", Value: anyRegexp(fc.FlairDeny)})
+	}
+	if fc.MaxAge.Duration > 0 {
+		rules = append(rules, Rule{Name: "max age", Field: "age_hours", Op: "gt", Value: fc.MaxAge.Hours()})
+	}
+	if fc.MinComments > 0 {
+		rules = append(rules, Rule{Name: "min comments", Field: "num_comments", Op: "lt", Value: float64(fc.MinComments)})
+	}
+	rules = append(rules, fc.Rules...)
+	var out []*Rule
+	for i := range rules {
+		r := rules[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("%s %s %v", r.Field, r.Op, r.Value)
+		}
+		switch r.Action {
+		case "":
+			r.Action = "deny"
+		case "deny", "require":
+		default:
+			return nil, fmt.Errorf("rule %s: unknown action %q", r.Name, r.Action)
+		}
+		switch r.Op {
+		case "eq", "ne":
+		case "match":
+			pattern, ok := r.Value.(string)
+			if !ok {
+				return nil, fmt.Errorf("rule %s: match needs a string", r.Name)
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %v", r.Name, err)
+			}
+			r.re = re
+		case "in":
+			if _, ok := r.Value.([]interface{}); !ok {
+				return nil, fmt.Errorf("rule %s: in needs a list", r.Name)
+			}
+		case "lt", "le", "gt", "ge":
+			_, isBool := r.Value.(bool)
+			if _, ok := toFloat(r.Value); !ok || isBool {
+				return nil, fmt.Errorf("rule %s: %s needs a number", r.Name, r.Op)
+			}
+		default:
+			return nil, fmt.Errorf("rule %s: unknown op %q", r.Name, r.Op)
+		}
+		if _, ok := fieldValue(reddit.Submission{}, r.Field, time.Now()); !ok {
+			return nil, fmt.Errorf("rule %s: unknown field %q", r.Name, r.Field)
+		}
+		out = append(out, &r)
+	}
+	return out, nil
+}
+
+// fieldValue looks a field up by its Reddit JSON name.
+func fieldValue(s reddit.Submission, name string, now time.Time) (interface{}, bool) {
+	if name == "age_hours" {
+		return now.Sub(s.CreatedTime()).Hours(), true
+	}
+	v := reflect.ValueOf(s)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if strings.Split(f.Tag.Get("json"), ",")[0] == name {
+			fv := v.Field(i)
+			for fv.Kind() == reflect.Ptr || fv.Kind() == reflect.Interface {
+				if fv.IsNil() {
+					return nil, true
+				}
+				fv = fv.Elem()
+			}
+			return fv.Interface(), true
+		}
+	}
+	return nil, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func (r *Rule) matches(s reddit.Submission, now time.Time) (bool, interface{}) {
+	got, _ := fieldValue(s, r.Field, now)
+	switch r.Op {
+	case "match":
+		return r.re.MatchString(fmt.Sprint(valueOrEmpty(got))), got
+	case "in":
+		list, _ := r.Value.([]interface{})
+		for _, v := range list {
+			if strings.EqualFold(fmt.Sprint(v), fmt.Sprint(valueOrEmpty(got))) {
+				return true, got
+			}
+		}
+		return false, got
+	case "eq", "ne":
+		eq := fmt.Sprint(valueOrEmpty(got)) == fmt.Sprint(r.Value)
+		if a, ok := toFloat(got); ok {
+			if b, ok := toFloat(r.Value); ok {
+				eq = a == b
+			}
+		}
+		return eq == (r.Op == "eq"), got
+	case "lt", "le", "gt", "ge":
+		a, ok1 := toFloat(got)
+		b, ok2 := toFloat(r.Value)
+		if !ok1 || !ok2 {
+			return false, got
+		}
+		switch r.Op {
+		case "lt":
+			return a < b, got
+		case "le":
+			return a <= b, got
+		case "gt":
+			return a > b, got
+		default:
+			return a >= b, got
+		}
+	}
+	return false, got
+}
+
+func valueOrEmpty(v interface{}) interface{} {
+	if v == nil {
+		return ""
+	}
+	return v
+}
+
+// Check returns the reason the rule rejects s, or "" if it passes.
+func (r *Rule) Check(s reddit.Submission, now time.Time) string {
+	m, got := r.matches(s, now)
+	if r.Action == "require" && !m {
+		return fmt.Sprintf("%s is %v", r.Field, valueOrEmpty(got))
+	}
+	if r.Action == "deny" && m {
+		return fmt.Sprintf("%s is %v", r.Field, valueOrEmpty(got))
+	}
+	return ""
+}
+
+// Verdict is the outcome of candidate selection for one submission.
+// Rule is empty when the submission is a candidate.
+type Verdict struct {
+	Submission reddit.Submission
+	Rule       string
+	Reason     string
+}
+
+func (v Verdict) Passed() bool {
+	return v.Rule == ""
+}
+
+// Evaluate runs every submission of the listing through the stickied and removed
+// checks, the author blocklist, dedup, the minimum score and the filter rules.
+func Evaluate(a *Account, st *store.Store, ss []reddit.Submission, minScore int) ([]Verdict, error) {
+	rules, err := a.Filter.Compile()
+	if err != nil {
+		return nil, err
+	}
+	var bl Blocklist
+	if err := st.GetState(blocklistKey, &bl); err != nil {
+		return nil, err
+	}
+	q, err := LoadQueue(st)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var vv []Verdict
+	for _, s := range ss {
+		v := Verdict{Submission: s}
+		switch {
+		case s.Stickied:
+			v.Rule, v.Reason = "stickied", "pinned by the moderators"
+		case s.Removed() != "":
+			v.Rule, v.Reason = "removed", s.Removed()
+		case bl.Contains(s.Author):
+			v.Rule, v.Reason = "blocklist", "u/"+s.Author+" is blocklisted"
+		case st.Contains(s):
+			v.Rule, v.Reason = "used", "already in the store"
+		case q.Get(s.ID) != nil:
+			v.Rule, v.Reason = "queued", q.Get(s.ID).Status+" in the approval queue"
+		case s.Score < minScore:
+			v.Rule, v.Reason = "minscore", fmt.Sprintf("score %d is below %d", s.Score, minScore)
+		default:
+			for _, r := range rules {
+				if reason := r.Check(s, now); reason != "" {
+					v.Rule, v.Reason = r.Name, reason
+					break
+				}
+			}
+		}
+		vv = append(vv, v)
+	}
+	return vv, nil
+}
+
+func RunFilter(ctx context.Context, a *Account, explain bool) error {
+	st := store.New(a.Store)
+	vv, err := EvaluateListing(ctx, a, st, a.Sub)
+	if err != nil {
+		return err
+	}
+	return WriteVerdicts(os.Stdout, vv, explain)
+}
+
+func WriteVerdicts(out io.Writer, vv []Verdict, explain bool) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	if explain {
+		fmt.Fprintln(w, "ID\tSCORE\tVERDICT\tRULE\tREASON\tTITLE")
+	} else {
+		fmt.Fprintln(w, "ID\tSCORE\tTITLE")
+	}
+	for _, v := range vv {
+		s := v.Submission
+		switch {
+		case explain && v.Passed():
+			fmt.Fprintf(w, "%s\t%d\tok\t-\t-\t%s\n", s.ID, s.Score, s.Title)
+		case explain:
+			fmt.Fprintf(w, "%s\t%d\trejected\t%s\t%s\t%s\n", s.ID, s.Score, v.Rule, v.Reason, s.Title)
+		case v.Passed():
+			fmt.Fprintf(w, "%s\t%d\t%s\n", s.ID, s.Score, s.Title)
+		}
+	}
+	return w.Flush()
+}
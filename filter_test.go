@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
+)
+
+func TestFilterRules(t *testing.T) {
+	now := time.Now()
+	base := reddit.Submission{
+		ID:          "abc",
+		Title:       "A funny cat",
+		Author:      "someone",
+		Domain:      "i.redd.it",
+		NumComments: 12,
+		Score:       500,
+		CreatedUTC:  float64(now.Add(-2 * time.Hour).Unix()),
+	}
+	with := func(f func(*reddit.Submission)) reddit.Submission {
+		s := base
+		f(&s)
+		return s
+	}
+	tests := []struct {
+		name string
+		fc   FilterConfig
+		s    reddit.Submission
+		rule string // the rejecting rule, "" if it passes
+	}{
+		{"default passes", FilterConfig{}, base, ""},
+		{"nsfw", FilterConfig{}, with(func(s *reddit.Submission) { s.Over18 = true }), "nsfw"},
+		{"nsfw allowed", FilterConfig{AllowNSFW: true}, with(func(s *reddit.Submission) { s.Over18 = true }), ""},
+		{"spoiler", FilterConfig{}, with(func(s *reddit.Submission) { s.Spoiler = true }), "spoiler"},
+		{"title deny", FilterConfig{TitleDeny: []string{`\bcat\b`}}, base, "title deny"},
+		{"title deny is case insensitive", FilterConfig{TitleDeny: []string{"FUNNY"}}, base, "title deny"},
+		{"title allow", FilterConfig{TitleAllow: []string{"dog"}}, base, "title allow"},
+		{"author allow", FilterConfig{AuthorAllow: []string{"SOMEONE"}}, base, ""},
+		{"author deny", FilterConfig{AuthorDeny: []string{"someone"}}, base, "author deny"},
+		{"domain allow", FilterConfig{DomainAllow: []string{"i.imgur.com"}}, base, "domain allow"},
+		{"flair deny without flair", FilterConfig{FlairDeny: []string{"^meta$"}}, base, ""},
+		{"flair deny", FilterConfig{FlairDeny: []string{"^meta$"}}, with(func(s *reddit.Submission) { s.LinkFlairText = "Meta" }), "flair deny"},
+		{"max age", FilterConfig{MaxAge: Duration{time.Hour}}, base, "max age"},
+		{"young enough", FilterConfig{MaxAge: Duration{3 * time.Hour}}, base, ""},
+		{"min comments", FilterConfig{MinComments: 20}, base, "min comments"},
+		{"rule gt", FilterConfig{Rules: []Rule{{Name: "popular", Field: "num_comments", Op: "gt", Value: 10.0}}}, base, "popular"},
+		{"rule require", FilterConfig{Rules: []Rule{{Field: "is_self", Op: "eq", Value: true, Action: "require"}}}, base, "is_self eq true"},
+		{"rule in", FilterConfig{Rules: []Rule{{Name: "domains", Field: "domain", Op: "in", Value: []interface{}{"I.REDD.IT"}}}}, base, "domains"},
+		{"rule ne", FilterConfig{Rules: []Rule{{Name: "not 500", Field: "score", Op: "ne", Value: 500.0}}}, base, ""},
+		{"rule age", FilterConfig{Rules: []Rule{{Name: "old", Field: "age_hours", Op: "ge", Value: 2.0}}}, base, "old"},
+		{"first rule wins", FilterConfig{MinComments: 20, Rules: []Rule{{Name: "any", Field: "score", Op: "gt", Value: 0.0}}}, base, "min comments"},
+	}
+	for _, tt := range tests {
+		rules, err := tt.fc.Compile()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := ""
+		for _, r := range rules {
+			if r.Check(tt.s, now) != "" {
+				got = r.Name
+				break
+			}
+		}
+		if got != tt.rule {
+			t.Errorf("%s: rejected by %q, want %q", tt.name, got, tt.rule)
+		}
+	}
+}
+
+func TestFilterCompileErrors(t *testing.T) {
+	for _, fc := range []FilterConfig{
+		{Rules: []Rule{{Field: "nope", Op: "eq", Value: 1.0}}},
+		{Rules: []Rule{{Field: "title", Op: "match", Value: "("}}},
+		{Rules: []Rule{{Field: "title", Op: "match", Value: 1.0}}},
+		{Rules: []Rule{{Field: "title", Op: "eq", Value: "x", Action: "maybe"}}},
+		{TitleDeny: []string{"["}},
+		{Rules: []Rule{{Field: "score", Op: "gte", Value: 10.0}}},
+		{Rules: []Rule{{Field: "score", Op: "ge", Value: "10"}}},
+		{Rules: []Rule{{Field: "score", Op: "lt", Value: true}}},
+		{Rules: []Rule{{Field: "author", Op: "in", Value: "someone"}}},
+	} {
+		if _, err := fc.Compile(); err == nil {
+			t.Errorf("%+v compiled", fc)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	a := DefaultAccount()
+	st := store.New(t.TempDir())
+	if err := st.Insert(&store.Record{ID: "used", Posted: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := BlockAuthor(st, &BlockedAuthor{Name: "Troll"}); err != nil {
+		t.Fatal(err)
+	}
+	created := float64(time.Now().Unix())
+	ss := []reddit.Submission{
+		{ID: "sticky", Score: 900, Stickied: true, CreatedUTC: created},
+		{ID: "removed", Score: 900, RemovedByCategory: "moderator", CreatedUTC: created},
+		{ID: "blocked", Score: 900, Author: "troll", CreatedUTC: created},
+		{ID: "used", Score: 900, CreatedUTC: created},
+		{ID: "low", Score: 10, CreatedUTC: created},
+		{ID: "nsfw", Score: 900, Over18: true, CreatedUTC: created},
+		{ID: "ok", Score: 900, CreatedUTC: created},
+	}
+	want := []string{"stickied", "removed", "blocklist", "used", "minscore", "nsfw", ""}
+	vv, err := Evaluate(a, st, ss, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range vv {
+		if v.Rule != want[i] {
+			t.Errorf("%s: rule %q (%s), want %q", v.Submission.ID, v.Rule, v.Reason, want[i])
+		}
+	}
+}
@@ -1,96 +1,253 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"flag"
 	"fmt"
-	"image"
-	"image/jpeg"
 	"log"
 	"os"
-	"sort"
+	"os/exec"
+	"time"
 
-	"github.com/ahmdrz/goinsta"
+	"github.com/LamaLamer/redigram/photo"
+	"github.com/LamaLamer/redigram/pipeline"
+	"github.com/LamaLamer/redigram/publish"
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
 )
 
-var (
-	subreddit = flag.String("sub", "memes", "The Subreddit to pull from")
-	username  = flag.String("username", "", "Instagram Username")
-	password  = flag.String("password", "", "Instagram Password")
-	storedir  = flag.String("store", "used", "Storage directory")
-	minscore  = flag.Int("minscore", 100, "Minimum score")
-	dryrun    = flag.Bool("dry", false, "Don't actually post the image")
+func main() {
+	err := RunCLI(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if qe, ok := err.(*QuotaError); ok {
+		fmt.Println(qe)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		os.Exit(ExitCode(err))
+	}
+}
+
+// Process exit codes for each error class, so schedulers can react.
+const (
+	ExitError      = 1
+	ExitTransient  = 3
+	ExitCheckpoint = 4
+	ExitPermanent  = 5
+	// the upload was cut off by a deadline, it may have been published
+	ExitInterrupted = 6
 )
 
-func init() {
-	flag.Parse()
+func ExitCode(err error) int {
+	ue, ok := err.(*publish.UploadError)
+	if !ok {
+		return ExitError
+	}
+	switch ue.Class {
+	case publish.ErrTransient:
+		return ExitTransient
+	case publish.ErrCheckpoint:
+		return ExitCheckpoint
+	case publish.ErrPermanent:
+		return ExitPermanent
+	case publish.ErrInterrupted:
+		return ExitInterrupted
+	default:
+		return ExitError
+	}
 }
 
-func main() {
-	if err := DoPost(); err != nil {
-		log.Fatal(err)
+// withTimeout bounds ctx by d, unless d is 0.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, d)
 }
 
-func DoPost() error {
-	st := NewStore(*storedir)
-	ss, err := FetchSubmissions(*subreddit)
+// DoPost runs the account once within the -runtimeout budget.
+func DoPost(ctx context.Context, a *Account) error {
+	ctx, cancel := withTimeout(ctx, settings.RunTimeout.Duration)
+	defer cancel()
+	st := store.New(a.Store)
+	if a.Approval {
+		return PostApproved(ctx, a, st)
+	}
+	pick, err := ChooseSource(a, st)
 	if err != nil {
 		return err
 	}
-	sort.Sort(ByScore(ss))
-	var unused []Submission
-	for _, s := range ss {
-		if !st.Contains(s) && s.Score >= *minscore {
-			unused = append(unused, s)
-		}
+	if a.Dry {
+		return DryRun(ctx, a, st, pick.Source)
+	}
+	if err := checkQuota(a, st, pick.Source); err != nil {
+		return err
 	}
-	p, err := MakeImagePost(st, unused)
+	unused, err := RankedCandidates(ctx, a, st, pick.Source)
 	if err != nil {
 		return err
 	}
-	if err := st.Insert(p.Submission); err != nil {
+	p, err := newPipeline(a, st).MakePost(ctx, unused)
+	if err != nil {
 		return err
 	}
-	fmt.Println(p)
-	if *dryrun {
-		return SavePost(p.Image)
+	if err := PublishPost(ctx, a, st, p); err != nil {
+		return err
 	}
-	return UploadPost(p)
+	return pick.Record(st)
 }
 
-type Post struct {
-	Image      image.Image
-	Caption    string
-	Submission Submission
+func checkQuota(a *Account, st *store.Store, sub string) error {
+	rr, err := st.Records()
+	if err != nil {
+		return err
+	}
+	return a.Quota.Check(rr, sub, time.Now())
 }
 
-func (p Post) String() string {
-	return fmt.Sprintf("Title: %s, Caption: %s", p.Submission.Title, p.Caption)
+// RankedCandidates returns the candidates of sub in the order of the
+// account's ranking, which is printed on dry runs. Runs that post or
+// fill the approval queue come through here, so unless it is a dry run
+// the listing is added to the score history of the dynamic minimum score.
+func RankedCandidates(ctx context.Context, a *Account, st *store.Store, sub string) ([]reddit.Submission, error) {
+	ss, err := newPipeline(a, st).Listing(ctx, sub)
+	if err != nil {
+		return nil, err
+	}
+	if !a.Dry {
+		if err := RecordScores(a, st, sub, ss); err != nil {
+			return nil, err
+		}
+	}
+	vv, err := evaluateSubmissions(a, st, sub, ss)
+	if err != nil {
+		return nil, err
+	}
+	unused := passed(vv)
+	rs, err := NewRankers(a, st)
+	if err != nil {
+		return nil, err
+	}
+	ranked := Rank(rs, unused, time.Now())
+	if a.Dry {
+		if err := WriteRanking(os.Stdout, rs, ranked); err != nil {
+			return nil, err
+		}
+	}
+	unused = unused[:0]
+	for _, rk := range ranked {
+		unused = append(unused, rk.Submission)
+	}
+	return unused, nil
 }
 
-func UploadPost(p *Post) error {
-	insta := goinsta.New(*username, *password)
-	if err := insta.Login(); err != nil {
-		return fmt.Errorf("failed to login: %v", err)
+// PublishPost records p in the store and sends it to every publisher
+// of the account. A dry run only saves the image into -out.
+func PublishPost(ctx context.Context, a *Account, st *store.Store, p *publish.Post) error {
+	fmt.Println(p)
+	if a.Dry {
+		_, err := SavePost(settings.Out, p)
+		return err
 	}
-	defer insta.Logout()
-	var buf bytes.Buffer
-	if err := jpeg.Encode(&buf, p.Image, nil); err != nil {
+	pubs, err := a.NewPublishers()
+	if err != nil {
 		return err
 	}
-	if _, err := insta.UploadPhoto(&buf, p.Caption, 87, 0); err != nil {
-		return fmt.Errorf("failed to upload: %v", err)
+	r := store.NewRecord(p.Submission)
+	r.Features = Features(p.Submission, photo.AspectRatio(p.Image), r.Posted)
+	perr := newPipeline(a, st).Publish(ctx, pubs, p, r)
+	if perr != nil && publish.ClassifyError(perr) == publish.ErrCheckpoint {
+		Notify(a, perr)
+	}
+	return perr
+}
+
+// newPipeline is the pipeline of the account under the current settings.
+func newPipeline(a *Account, st *store.Store) *pipeline.Pipeline {
+	fc := &a.Filter
+	return &pipeline.Pipeline{
+		Store:  st,
+		Client: httpClient(),
+		Limits: photo.Limits{MaxBytes: settings.MaxImageBytes, MaxPixels: settings.MaxImagePixels},
+		Rules: pipeline.ImageRules{
+			MinWidth:          fc.MinWidth,
+			MinHeight:         fc.MinHeight,
+			MinAspect:         fc.MinAspect,
+			MaxAspect:         fc.MaxAspect,
+			DuplicateDistance: fc.DuplicateDistance,
+		},
+		CaptionStyle:   a.Caption,
+		Workers:        settings.Workers,
+		Prefetch:       settings.Prefetch,
+		ListingTimeout: settings.ListingTimeout.Duration,
+		ImageTimeout:   settings.ImageTimeout.Duration,
+		UploadTimeout:  settings.UploadTimeout.Duration,
 	}
-	return nil
 }
 
-func SavePost(im image.Image) error {
-	fmt.Println("writing to post.jpeg")
-	f, err := os.Create("post.jpeg")
+// EvaluateListing fetches sub and decides for every submission,
+// highest score first, whether it is a candidate. The store is
+// not changed.
+func EvaluateListing(ctx context.Context, a *Account, st *store.Store, sub string) ([]Verdict, error) {
+	ss, err := newPipeline(a, st).Listing(ctx, sub)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return evaluateSubmissions(a, st, sub, ss)
+}
+
+func evaluateSubmissions(a *Account, st *store.Store, sub string, ss []reddit.Submission) ([]Verdict, error) {
+	minScore, err := EffectiveMinScore(a, st, sub, ss)
+	if err != nil {
+		return nil, err
+	}
+	return Evaluate(a, st, ss, minScore)
+}
+
+// fetchByID looks submissions up within the -listingtimeout deadline.
+func fetchByID(ctx context.Context, ids []string) ([]reddit.Submission, error) {
+	ctx, cancel := withTimeout(ctx, settings.ListingTimeout.Duration)
+	defer cancel()
+	return redditClient().ByID(ctx, ids)
+}
+
+// Candidates returns the unused submissions of sub that pass
+// the minimum score and filter rules, highest score first.
+func Candidates(ctx context.Context, a *Account, st *store.Store, sub string) ([]reddit.Submission, error) {
+	vv, err := EvaluateListing(ctx, a, st, sub)
+	if err != nil {
+		return nil, err
+	}
+	return passed(vv), nil
+}
+
+func passed(vv []Verdict) []reddit.Submission {
+	var unused []reddit.Submission
+	for _, v := range vv {
+		if v.Passed() {
+			unused = append(unused, v.Submission)
+		}
+	}
+	return unused
+}
+
+// Notify runs the -notify command for an account that needs attention.
+func Notify(a *Account, err error) {
+	log.Printf("account %s needs attention: %v", a, err)
+	if settings.Notify == "" {
+		return
+	}
+	cmd := exec.Command("sh", "-c", settings.Notify)
+	cmd.Env = append(os.Environ(),
+		"REDIGRAM_ACCOUNT="+a.Name,
+		"REDIGRAM_ERROR="+err.Error(),
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("notify: %v", err)
 	}
-	defer f.Close()
-	return jpeg.Encode(f, im, &jpeg.Options{Quality: jpeg.DefaultQuality})
 }
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LamaLamer/redigram/fakeinsta"
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
+)
+
+// redditStub serves a listing of image posts and their images in
+// place of Reddit, as the Transport of every Reddit and image request.
+type redditStub struct {
+	sub    string
+	ss     []reddit.Submission
+	images map[string][]byte // by url
+
+	mu   sync.Mutex
+	hits map[string]int // requests by url
+}
+
+func newRedditStub(sub string, n int) *redditStub {
+	rs := &redditStub{sub: sub, images: map[string][]byte{}, hits: map[string]int{}}
+	created := float64(time.Now().Add(-time.Hour).Unix())
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("post%d", i+1)
+		url := "https://i.redd.it/" + id + ".jpg"
+		rs.ss = append(rs.ss, reddit.Submission{
+			ID:          id,
+			Name:        "t3_" + id,
+			Title:       fmt.Sprintf("Post number %d", i+1),
+			Domain:      "i.redd.it",
+			URL:         url,
+			Permalink:   "/r/" + sub + "/comments/" + id + "/",
+			Author:      fmt.Sprintf("author%d", i+1),
+			Subreddit:   sub,
+			Score:       1000 - 100*i,
+			NumComments: 10,
+			Created:     created,
+			CreatedUTC:  created,
+		})
+		rs.images[url] = testJPEG(i)
+	}
+	return rs
+}
+
+// testJPEG is an image with a pattern of its own for every seed,
+// so their hashes differ.
+func testJPEG(seed int) []byte {
+	im := image.NewRGBA(image.Rect(0, 0, 90, 60))
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 90; x++ {
+			v := uint8((x*(seed+2)*29 + y*(seed+5)*13) % 251)
+			im.Set(x, y, color.RGBA{v, 255 - v, uint8(seed * 40), 255})
+		}
+	}
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, im, nil)
+	return buf.Bytes()
+}
+
+func (rs *redditStub) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	rs.mu.Lock()
+	rs.hits[req.URL.String()]++
+	rs.mu.Unlock()
+	status, ctype := http.StatusOK, "application/json"
+	var body []byte
+	switch u := req.URL.String(); {
+	case u == "https://reddit.com/r/"+rs.sub+".json":
+		body, _ = json.Marshal(rs.listing(nil))
+	case strings.HasPrefix(u, "https://reddit.com/by_id/"):
+		names := strings.Split(strings.TrimSuffix(strings.TrimPrefix(u, "https://reddit.com/by_id/"), ".json"), ",")
+		body, _ = json.Marshal(rs.listing(names))
+	case rs.images[u] != nil:
+		body, ctype = rs.images[u], "image/jpeg"
+	default:
+		status, body = http.StatusNotFound, []byte(`{"error": 404}`)
+	}
+	return &http.Response{
+		Status:     http.StatusText(status),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type": {ctype},
+			// like Reddit, hand out a session to whoever asks
+			"Set-Cookie":    {"session_tracker=s3cr3t; Domain=reddit.com; Path=/; Secure"},
+			"X-Reddit-Loid": {"000000000abcdef"},
+		},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+type stubChild struct {
+	Kind string            `json:"kind"`
+	Data reddit.Submission `json:"data"`
+}
+
+type stubListing struct {
+	Data struct {
+		Children []stubChild `json:"children"`
+	} `json:"data"`
+}
+
+// listing holds the submissions of the stub with the given
+// names, all of them when names is nil.
+func (rs *redditStub) listing(names []string) stubListing {
+	want := map[string]bool{}
+	for _, n := range names {
+		want[n] = true
+	}
+	var l stubListing
+	for _, s := range rs.ss {
+		if names == nil || want[s.Name] {
+			l.Data.Children = append(l.Data.Children, stubChild{"t3", s})
+		}
+	}
+	return l
+}
+
+func (rs *redditStub) requests(url string) int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.hits[url]
+}
+
+// testEnv points the package globals at fakes for one test:
+// Reddit is a redditStub and Instagram a fakeinsta server.
+type testEnv struct {
+	insta  *fakeinsta.Server
+	reddit *redditStub
+	a      *Account
+	st     *store.Store
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	savedSettings, savedTransport := settings, Transport
+	t.Cleanup(func() { settings, Transport = savedSettings, savedTransport })
+	settings = DefaultSettings()
+	settings.Backoff = Duration{time.Millisecond}
+	insta := fakeinsta.NewServer()
+	t.Cleanup(insta.Close)
+	rs := newRedditStub("memes", 3)
+	Transport = rs
+	a := DefaultAccount()
+	a.Name = "test"
+	a.Username = "user"
+	a.Password = "pass"
+	a.MinScore = 10
+	a.Store = t.TempDir()
+	a.Publishers = []PublisherConfig{{Type: "instagram"}}
+	a.InstagramProxy = insta.ProxyURL()
+	return &testEnv{insta: insta, reddit: rs, a: a, st: store.New(a.Store)}
+}
+
+func (e *testEnv) count(endpoint string) int {
+	var n int
+	for _, r := range e.insta.Requests() {
+		if r == endpoint {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDoPost(t *testing.T) {
+	e := newTestEnv(t)
+	if err := DoPost(context.Background(), e.a); err != nil {
+		t.Fatal(err)
+	}
+	mm := e.insta.Media()
+	if len(mm) != 1 {
+		t.Fatalf("%d media published", len(mm))
+	}
+	r, err := e.st.Get("post1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != "" || len(r.Results) != 1 || r.Results[0].ID != mm[0].ID || r.Results[0].Code != mm[0].Code {
+		t.Errorf("record %+v, results %+v, media %+v", r, r.Results, mm[0])
+	}
+	if r.Caption != mm[0].Caption || r.ImageHash == 0 {
+		t.Errorf("caption %q, published %q, hash %x", r.Caption, mm[0].Caption, r.ImageHash)
+	}
+
+	// the next run takes the next candidate
+	if err := DoPost(context.Background(), e.a); err != nil {
+		t.Fatal(err)
+	}
+	if !e.st.Has("post2") || len(e.insta.Media()) != 2 {
+		t.Errorf("second run: post2 stored %v, %d media", e.st.Has("post2"), len(e.insta.Media()))
+	}
+}
+
+func TestDoPostCaption(t *testing.T) {
+	e := newTestEnv(t)
+	e.a.Caption = "title+hashtags"
+	if err := DoPost(context.Background(), e.a); err != nil {
+		t.Fatal(err)
+	}
+	mm := e.insta.Media()
+	if len(mm) != 1 || !strings.HasPrefix(mm[0].Caption, "Post number 1") {
+		t.Fatalf("media %+v", mm)
+	}
+	r, err := e.st.Get("post1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Caption != mm[0].Caption {
+		t.Errorf("caption %q, published %q", r.Caption, mm[0].Caption)
+	}
+}
+
+func TestDoPostCheckpoint(t *testing.T) {
+	e := newTestEnv(t)
+	e.insta.Fail("upload/photo/", fakeinsta.Checkpoint)
+	err := DoPost(context.Background(), e.a)
+	if code := ExitCode(err); code != ExitCheckpoint {
+		t.Fatalf("exit code %d, want %d: %v", code, ExitCheckpoint, err)
+	}
+	if n := e.count("upload/photo/"); n != 1 {
+		t.Errorf("%d uploads, a checkpoint is not retried", n)
+	}
+	if e.st.Has("post1") {
+		t.Error("post1 was kept, it should be released for a later run")
+	}
+	if len(e.insta.Media()) != 0 {
+		t.Error("media published")
+	}
+}
+
+func TestDoPostTransientRetry(t *testing.T) {
+	e := newTestEnv(t)
+	e.insta.Fail("upload/photo/", fakeinsta.Unavailable)
+	if err := DoPost(context.Background(), e.a); err != nil {
+		t.Fatal(err)
+	}
+	if n := e.count("upload/photo/"); n != 2 {
+		t.Errorf("%d uploads, want 2", n)
+	}
+	if len(e.insta.Media()) != 1 || !e.st.Has("post1") {
+		t.Errorf("%d media, post1 stored %v", len(e.insta.Media()), e.st.Has("post1"))
+	}
+}
+
+func TestDoPostTransientGivesUp(t *testing.T) {
+	e := newTestEnv(t)
+	settings.Retries = 1
+	e.insta.Fail("upload/photo/", fakeinsta.Unavailable, fakeinsta.Unavailable)
+	err := DoPost(context.Background(), e.a)
+	if code := ExitCode(err); code != ExitTransient {
+		t.Fatalf("exit code %d, want %d: %v", code, ExitTransient, err)
+	}
+	if e.st.Has("post1") {
+		t.Error("post1 was kept, it should be released for a later run")
+	}
+}
+
+func TestDoPostInterrupted(t *testing.T) {
+	e := newTestEnv(t)
+	// configure is where the post is created, hold it and cancel meanwhile
+	e.insta.Fail("media/configure/", fakeinsta.Fault{Delay: 300 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for e.count("media/configure/") == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		cancel()
+	}()
+	err := DoPost(ctx, e.a)
+	if code := ExitCode(err); code != ExitInterrupted {
+		t.Fatalf("exit code %d, want %d: %v", code, ExitInterrupted, err)
+	}
+	r, err := e.st.Get("post1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != store.StatusInterrupted {
+		t.Errorf("status %q, want %q", r.Status, store.StatusInterrupted)
+	}
+
+	// the held request still goes through, post1 must not be sent again
+	for deadline := time.Now().Add(5 * time.Second); len(e.insta.Media()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the held upload never finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := DoPost(context.Background(), e.a); err != nil {
+		t.Fatal(err)
+	}
+	mm := e.insta.Media()
+	if len(mm) != 2 || !e.st.Has("post2") {
+		t.Fatalf("%d media, post2 stored %v", len(mm), e.st.Has("post2"))
+	}
+}
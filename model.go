@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat"
+)
+
+const (
+	modelRidge   = 1.0
+	modelMinRows = 10
+)
+
+// Features describes a submission the way the engagement model sees it.
+// aspect is width/height of the image, 0 when it is not known yet.
+func Features(s reddit.Submission, aspect float64, now time.Time) map[string]float64 {
+	age := now.Sub(s.CreatedTime()).Hours()
+	if age < 0.25 {
+		age = 0.25
+	}
+	score := math.Max(float64(s.Score), 0)
+	hour := 2 * math.Pi * float64(now.Hour()) / 24
+	f := map[string]float64{
+		"score":         math.Log1p(score),
+		"score_per_h":   math.Log1p(score / age),
+		"comment_ratio": float64(s.NumComments) / math.Max(score, 1),
+		"age_h":         age,
+		"title_length":  float64(utf8.RuneCountInString(s.Title)),
+		"aspect":        aspect,
+		"hour_sin":      math.Sin(hour),
+		"hour_cos":      math.Cos(hour),
+	}
+	if s.Subreddit != "" {
+		f["sub:"+strings.ToLower(s.Subreddit)] = 1
+	}
+	return f
+}
+
+// Model is a ridge regression of likes per thousand followers
+// on standardized submission features.
+type Model struct {
+	Checkpoint string
+	Rows       int
+	Names      []string
+	Mean       []float64
+	Std        []float64
+	Coef       []float64
+	Intercept  float64
+}
+
+func modelTarget(r *store.Record, checkpoint string) (float64, bool) {
+	m := r.MetricAt(checkpoint)
+	if m == nil || m.Followers == 0 || len(r.Features) == 0 {
+		return 0, false
+	}
+	return 1000 * float64(m.Likes) / float64(m.Followers), true
+}
+
+// TrainModel fits the model on every record with features and
+// engagement at the checkpoint.
+func TrainModel(rr []*store.Record, checkpoint string) (*Model, error) {
+	var (
+		rows []map[string]float64
+		ys   []float64
+	)
+	names := map[string]bool{}
+	for _, r := range rr {
+		y, ok := modelTarget(r, checkpoint)
+		if !ok {
+			continue
+		}
+		rows = append(rows, r.Features)
+		ys = append(ys, y)
+		for name := range r.Features {
+			names[name] = true
+		}
+	}
+	if len(rows) < modelMinRows {
+		return nil, fmt.Errorf("not enough engagement history to train: %d posts with %s metrics, need %d",
+			len(rows), checkpoint, modelMinRows)
+	}
+	m := &Model{Checkpoint: checkpoint, Rows: len(rows)}
+	for name := range names {
+		m.Names = append(m.Names, name)
+	}
+	sort.Strings(m.Names)
+	p := len(m.Names)
+	col := make([]float64, len(rows))
+	for _, name := range m.Names {
+		for i, row := range rows {
+			col[i] = row[name]
+		}
+		mean, std := stat.MeanStdDev(col, nil)
+		if std == 0 || math.IsNaN(std) {
+			std = 1
+		}
+		m.Mean = append(m.Mean, mean)
+		m.Std = append(m.Std, std)
+	}
+	// the extra p rows shrink every coefficient towards zero,
+	// which keeps the fit stable with few posts and many subreddits
+	n := len(rows)
+	x := mat.NewDense(n+p, p+1, nil)
+	y := mat.NewVecDense(n+p, nil)
+	for i, row := range rows {
+		x.Set(i, 0, 1)
+		for j := range m.Names {
+			x.Set(i, j+1, m.standardize(j, row))
+		}
+		y.SetVec(i, ys[i])
+	}
+	for j := 0; j < p; j++ {
+		x.Set(n+j, j+1, math.Sqrt(modelRidge))
+	}
+	var beta mat.VecDense
+	if err := beta.SolveVec(x, y); err != nil {
+		return nil, fmt.Errorf("training model: %v", err)
+	}
+	m.Intercept = beta.AtVec(0)
+	for j := 0; j < p; j++ {
+		m.Coef = append(m.Coef, beta.AtVec(j+1))
+	}
+	return m, nil
+}
+
+// standardize returns feature j of f in standard units.
+// An unknown aspect ratio is imputed with the training mean.
+func (m *Model) standardize(j int, f map[string]float64) float64 {
+	v, ok := f[m.Names[j]]
+	if !ok && !strings.HasPrefix(m.Names[j], "sub:") {
+		return 0
+	}
+	if m.Names[j] == "aspect" && v == 0 {
+		return 0
+	}
+	return (v - m.Mean[j]) / m.Std[j]
+}
+
+type Contribution struct {
+	Feature string
+	Value   float64
+	Effect  float64
+}
+
+// Explain returns how much every feature moved the prediction
+// away from the intercept, largest effect first.
+func (m *Model) Explain(f map[string]float64) []Contribution {
+	var cc []Contribution
+	for j, name := range m.Names {
+		cc = append(cc, Contribution{
+			Feature: name,
+			Value:   f[name],
+			Effect:  m.Coef[j] * m.standardize(j, f),
+		})
+	}
+	sort.Slice(cc, func(i, j int) bool {
+		return math.Abs(cc[i].Effect) > math.Abs(cc[j].Effect)
+	})
+	return cc
+}
+
+// Predict returns the expected likes per thousand followers.
+func (m *Model) Predict(f map[string]float64) float64 {
+	y := m.Intercept
+	for _, c := range m.Explain(f) {
+		y += c.Effect
+	}
+	return y
+}
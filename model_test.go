@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
+)
+
+// linearRecords are posts whose likes per thousand followers
+// are 5 + 2*score + 3*aspect.
+func linearRecords(n int) []*store.Record {
+	rng := rand.New(rand.NewSource(1))
+	var rr []*store.Record
+	for i := 0; i < n; i++ {
+		score, aspect := 10*rng.Float64(), 0.5+rng.Float64()
+		y := 5 + 2*score + 3*aspect
+		rr = append(rr, &store.Record{
+			ID:       fmt.Sprintf("post%d", i),
+			Features: map[string]float64{"score": score, "aspect": aspect},
+			Metrics:  []*store.Metric{{Checkpoint: "24h", Likes: int(math.Round(1000 * y)), Followers: 1000000}},
+		})
+	}
+	return rr
+}
+
+func TestTrainModelLinear(t *testing.T) {
+	m, err := TrainModel(linearRecords(500), "24h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Rows != 500 {
+		t.Errorf("trained on %d rows, want 500", m.Rows)
+	}
+	for _, tt := range []struct{ score, aspect float64 }{
+		{0, 1}, {5, 1}, {10, 0.5}, {2.5, 1.5},
+	} {
+		want := 5 + 2*tt.score + 3*tt.aspect
+		got := m.Predict(map[string]float64{"score": tt.score, "aspect": tt.aspect})
+		if math.Abs(got-want) > 0.02*want {
+			t.Errorf("Predict(score %g, aspect %g) = %.3f, want %.3f", tt.score, tt.aspect, got, want)
+		}
+	}
+	// an unknown aspect counts as the average one
+	got := m.Predict(map[string]float64{"score": 5, "aspect": 0})
+	want := m.Predict(map[string]float64{"score": 5, "aspect": m.Mean[0]})
+	if math.Abs(got-want) > 1e-9 {
+		t.Errorf("Predict with unknown aspect = %.3f, want %.3f", got, want)
+	}
+}
+
+func TestTrainModelTooFewRows(t *testing.T) {
+	if _, err := TrainModel(linearRecords(modelMinRows-1), "24h"); err == nil {
+		t.Error("trained on too few posts")
+	}
+	if _, err := TrainModel(linearRecords(modelMinRows), "7d"); err == nil {
+		t.Error("trained without metrics at the checkpoint")
+	}
+}
+
+func TestPredictExplain(t *testing.T) {
+	now := time.Date(2026, 10, 19, 18, 0, 0, 0, time.UTC)
+	var rr []*store.Record
+	for i := 0; i < 20; i++ {
+		s := reddit.Submission{
+			Title:       fmt.Sprintf("post %d", i),
+			Score:       100 * i,
+			NumComments: 3 * i,
+			CreatedUTC:  float64(now.Add(-time.Duration(i+1) * time.Hour).Unix()),
+			Subreddit:   []string{"pics", "earthporn"}[i%2],
+		}
+		rr = append(rr, &store.Record{
+			ID:       fmt.Sprintf("post%d", i),
+			Features: Features(s, 0.5+float64(i%4)/4, now),
+			Metrics:  []*store.Metric{{Checkpoint: "24h", Likes: 20 + 7*i + 13*(i%3), Followers: 1000}},
+		})
+	}
+	m, err := TrainModel(rr, "24h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := reddit.Submission{Title: "fixture", Score: 850, NumComments: 40, CreatedUTC: float64(now.Add(-3 * time.Hour).Unix()), Subreddit: "Pics"}
+	for _, aspect := range []float64{0, 0.8, 1.5} {
+		f := Features(s, aspect, now)
+		cc := m.Explain(f)
+		if len(cc) != len(m.Names) {
+			t.Fatalf("%d contributions, want one for each of %d features", len(cc), len(m.Names))
+		}
+		sum := m.Intercept
+		for i, c := range cc {
+			sum += c.Effect
+			if i > 0 && math.Abs(c.Effect) > math.Abs(cc[i-1].Effect) {
+				t.Errorf("aspect %g: %s explained after a smaller effect", aspect, c.Feature)
+			}
+			if c.Feature == "aspect" && aspect == 0 && c.Effect != 0 {
+				t.Errorf("unknown aspect has effect %g", c.Effect)
+			}
+		}
+		if got := m.Predict(f); math.Abs(got-sum) > 1e-9 {
+			t.Errorf("aspect %g: Predict = %g, intercept and effects add up to %g", aspect, got, sum)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package photo
+
+import "fmt"
+
+// StatusError is a download answered with a status other than 200.
+type StatusError struct {
+	Status int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %d", e.Status)
+}
+
+// Temporary reports whether a later download may succeed.
+func (e *StatusError) Temporary() bool {
+	return e.Status == 429 || e.Status >= 500
+}
+
+// ContentTypeError is a response that is not an image, like an error page.
+type ContentTypeError struct {
+	Type string
+}
+
+func (e *ContentTypeError) Error() string {
+	return fmt.Sprintf("content type %q is not an image", e.Type)
+}
+
+// SizeError is a response body of more than Max bytes. Size is
+// the announced length, or -1 when the body was cut off.
+type SizeError struct {
+	Size, Max int64
+}
+
+func (e *SizeError) Error() string {
+	if e.Size < 0 {
+		return fmt.Sprintf("image is larger than %d bytes", e.Max)
+	}
+	return fmt.Sprintf("image of %d bytes is larger than %d", e.Size, e.Max)
+}
+
+// PixelError is an image whose header announces more than Max pixels.
+type PixelError struct {
+	Width, Height, Max int
+}
+
+func (e *PixelError) Error() string {
+	return fmt.Sprintf("image of %dx%d has more than %d pixels", e.Width, e.Height, e.Max)
+}
+
+// FormatError is data that does not decode as a supported image.
+type FormatError struct {
+	Err error
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("bad image: %v", e.Err)
+}
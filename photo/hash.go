@@ -0,0 +1,38 @@
+package photo
+
+import (
+	"image"
+	"math/bits"
+)
+
+// Hash is a difference hash of an image: it compares the brightness of
+// neighbouring cells of a 9x8 grid, so resized or recompressed copies of
+// an image get the same or a very close hash.
+func Hash(im image.Image) uint64 {
+	b := im.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return 0
+	}
+	var gray [8][9]uint32
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 9; x++ {
+			r, g, bl, _ := im.At(b.Min.X+(2*x+1)*b.Dx()/18, b.Min.Y+(2*y+1)*b.Dy()/16).RGBA()
+			gray[y][x] = (299*r + 587*g + 114*bl) / 1000
+		}
+	}
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			h <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+// Distance is the number of bits two hashes differ in.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
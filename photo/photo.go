@@ -0,0 +1,120 @@
+// Package photo downloads and encodes the images of submissions.
+package photo
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	_ "image/png" // png links are candidates too
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+func IsImageURL(url string) bool {
+	switch strings.ToLower(path.Ext(url)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	default:
+		return false
+	}
+}
+
+// Limits bound what Download and Decode accept, 0 for no limit.
+type Limits struct {
+	MaxBytes  int64 // size of the response body
+	MaxPixels int   // width times height, checked before decoding
+}
+
+var DefaultLimits = Limits{MaxBytes: 20 << 20, MaxPixels: 40000000}
+
+// Fetch downloads and decodes the image at url with hc,
+// or http.DefaultClient when hc is nil.
+func Fetch(ctx context.Context, hc *http.Client, url string, lim Limits) (image.Image, error) {
+	data, err := Download(ctx, hc, url, lim)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(data, lim)
+}
+
+// Download returns the body of url, so it can be cached before decoding.
+// Responses that are not a 200, not an image or too large fail with
+// a StatusError, ContentTypeError or SizeError.
+func Download(ctx context.Context, hc *http.Client, url string, lim Limits) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Status: resp.StatusCode}
+	}
+	// hosts that don't know better send octet-stream, decoding tells
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil || (!strings.HasPrefix(mt, "image/") && mt != "application/octet-stream") {
+			return nil, &ContentTypeError{Type: ct}
+		}
+	}
+	if lim.MaxBytes <= 0 {
+		return ioutil.ReadAll(resp.Body)
+	}
+	if resp.ContentLength > lim.MaxBytes {
+		return nil, &SizeError{Size: resp.ContentLength, Max: lim.MaxBytes}
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, lim.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > lim.MaxBytes {
+		return nil, &SizeError{Size: -1, Max: lim.MaxBytes}
+	}
+	return data, nil
+}
+
+// Decode reads the image header first and fails with a PixelError
+// instead of allocating an image larger than lim.MaxPixels.
+func Decode(data []byte, lim Limits) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, &FormatError{Err: err}
+	}
+	if lim.MaxPixels > 0 && (cfg.Width > lim.MaxPixels || cfg.Height > lim.MaxPixels ||
+		cfg.Width*cfg.Height > lim.MaxPixels) {
+		return nil, &PixelError{Width: cfg.Width, Height: cfg.Height, Max: lim.MaxPixels}
+	}
+	m, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, &FormatError{Err: err}
+	}
+	return m, nil
+}
+
+// EncodeJPEG encodes im the way it is uploaded.
+func EncodeJPEG(im image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, im, &jpeg.Options{Quality: jpeg.DefaultQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func AspectRatio(im image.Image) float64 {
+	b := im.Bounds()
+	if b.Dy() == 0 {
+		return 0
+	}
+	return float64(b.Dx()) / float64(b.Dy())
+}
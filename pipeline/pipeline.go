@@ -0,0 +1,187 @@
+// Package pipeline turns submissions into published posts: it fetches
+// listings, downloads and checks the images, captions them and sends
+// them to the publishers, keeping the store up to date on the way.
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/LamaLamer/redigram/caption"
+	"github.com/LamaLamer/redigram/photo"
+	"github.com/LamaLamer/redigram/publish"
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
+)
+
+// Pipeline holds what a run needs besides the submissions.
+// A zero timeout or count means no limit.
+type Pipeline struct {
+	Store *store.Store
+	// Client makes the Reddit and image requests, http.DefaultClient when nil.
+	Client *http.Client
+	Limits photo.Limits
+	Rules  ImageRules
+	// CaptionStyle is how captions are made: title, hashtags or title+hashtags.
+	CaptionStyle string
+
+	Workers  int // parallel image downloads
+	Prefetch int // candidates checked at a time
+
+	ListingTimeout time.Duration
+	ImageTimeout   time.Duration
+	UploadTimeout  time.Duration
+}
+
+// CaptionStyles are the values of Pipeline.CaptionStyle, "" is title.
+var CaptionStyles = []string{"title", "hashtags", "title+hashtags"}
+
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+func (pl *Pipeline) client() *http.Client {
+	if pl.Client == nil {
+		return http.DefaultClient
+	}
+	return pl.Client
+}
+
+// Listing returns the listing of sub, highest score first.
+func (pl *Pipeline) Listing(ctx context.Context, sub string) ([]reddit.Submission, error) {
+	ctx, cancel := withTimeout(ctx, pl.ListingTimeout)
+	defer cancel()
+	ss, err := reddit.NewClient(pl.client()).Listing(ctx, sub)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(reddit.ByScore(ss))
+	return ss, nil
+}
+
+// Caption returns the caption of s in the pipeline's style. When no
+// hashtags can be made the title is used.
+func (pl *Pipeline) Caption(s reddit.Submission) string {
+	if pl.CaptionStyle == "" || pl.CaptionStyle == "title" {
+		return s.Title
+	}
+	tags, err := caption.Make(s.Title)
+	if err != nil {
+		log.Printf("%s: no hashtags: %v", s.ID, err)
+		return s.Title
+	}
+	tags = strings.TrimSpace(tags)
+	switch {
+	case tags == "":
+		return s.Title
+	case pl.CaptionStyle == "hashtags":
+		return tags
+	default:
+		return s.Title + "\n\n" + tags
+	}
+}
+
+// MakePost prefetches the image submissions of ss, Prefetch at a time,
+// and returns a post of the first one whose image passes.
+func (pl *Pipeline) MakePost(ctx context.Context, ss []reddit.Submission) (*publish.Post, error) {
+	var images []reddit.Submission
+	for _, s := range ss {
+		if photo.IsImageURL(s.URL) {
+			images = append(images, s)
+		}
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("all %d submissions are used", len(ss))
+	}
+	var lastErr error
+	for len(images) > 0 {
+		n := pl.Batch(len(images))
+		pp, err := pl.PrefetchImages(ctx, images[:n])
+		if err != nil {
+			return nil, err
+		}
+		images = images[n:]
+		for _, p := range pp {
+			if p.Err != nil {
+				log.Printf("%s: %v", p.Submission.ID, p.Err)
+				lastErr = p.Err
+				continue
+			}
+			post, err := pl.Post(ctx, p)
+			if Rejected(err) {
+				// the cached image does not decode under the current limits,
+				// or was gone and could not be downloaded again
+				log.Printf("%s: %v", p.Submission.ID, err)
+				lastErr = err
+				continue
+			}
+			return post, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no usable image among %d submissions, last: %v", len(ss), lastErr)
+}
+
+// Rejected reports whether err is about the image itself,
+// so another candidate may do.
+func Rejected(err error) bool {
+	switch err.(type) {
+	case *ImageError, *photo.SizeError, *photo.PixelError, *photo.FormatError:
+		return true
+	}
+	return false
+}
+
+// Publish records r in the store and sends p to every publisher within
+// UploadTimeout. r is the record of p, the caller may fill in features.
+// When nothing was published r is released for a later run, unless the
+// upload was interrupted: then it is kept as such, so it is not published twice.
+func (pl *Pipeline) Publish(ctx context.Context, pubs []publish.Publisher, p *publish.Post, r *store.Record) error {
+	r.Caption = p.Caption
+	r.ImageHash = photo.Hash(p.Image)
+	if err := pl.Store.Insert(r); err != nil {
+		return err
+	}
+	uctx, cancel := withTimeout(ctx, pl.UploadTimeout)
+	results, perr := publish.Publish(uctx, pubs, p)
+	cancel()
+	r.Results = results
+	switch {
+	case perr == nil || published(results):
+	case publish.ClassifyError(perr) == publish.ErrPermanent:
+		r.Status = store.StatusFailed
+		r.Error = perr.Error()
+	case publish.ClassifyError(perr) == publish.ErrInterrupted:
+		r.Status = store.StatusInterrupted
+		r.Error = perr.Error()
+	default:
+		// nothing was posted, a later run may pick it up again
+		if err := pl.Store.Remove(r.ID); err != nil {
+			log.Printf("failed to release %s: %v", r.ID, err)
+		}
+		return perr
+	}
+	if err := pl.Store.Insert(r); err != nil {
+		log.Printf("failed to record results for %s: %v", r.ID, err)
+	}
+	return perr
+}
+
+func published(results []*publish.Result) bool {
+	for _, res := range results {
+		if res.Error == "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,328 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/LamaLamer/redigram/photo"
+	"github.com/LamaLamer/redigram/publish"
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
+)
+
+// ImageError tells why the image of a candidate can not be posted.
+// Rule is one of fetch, status, content type, size, pixels, format,
+// duplicate, resolution or aspect.
+type ImageError struct {
+	Rule   string
+	Reason string
+}
+
+func (e *ImageError) Error() string {
+	return e.Rule + ": " + e.Reason
+}
+
+// prefetchEntry is what is known about a downloaded image. The image
+// itself is kept in the store as state "prefetch-<id>", unless the
+// download was rejected for good, then Rule and Reason say why.
+type prefetchEntry struct {
+	Time   time.Time `json:"time"`
+	Width  int       `json:"width"`
+	Height int       `json:"height"`
+	Hash   uint64    `json:"hash"`
+	Rule   string    `json:"rule,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	// Limit is the MaxBytes or MaxPixels a size or pixels
+	// rejection was made under.
+	Limit int64 `json:"limit,omitempty"`
+}
+
+// stale reports whether a size or pixels rejection was made under a
+// lower limit than the current one, so the image may pass now.
+func (e *prefetchEntry) stale(lim photo.Limits) bool {
+	var limit int64
+	switch e.Rule {
+	case "size":
+		limit = lim.MaxBytes
+	case "pixels":
+		limit = int64(lim.MaxPixels)
+	default:
+		return false
+	}
+	return limit <= 0 || limit > e.Limit
+}
+
+// prefetchIndex is stored as state "prefetch", keyed by submission id.
+type prefetchIndex struct {
+	Entries map[string]*prefetchEntry `json:"entries"`
+}
+
+const (
+	prefetchKey = "prefetch"
+	// prefetchTTL is how long downloaded images are kept for later runs.
+	prefetchTTL = 24 * time.Hour
+)
+
+func prefetchDataKey(id string) string {
+	return "prefetch-" + id
+}
+
+// Prefetched is a candidate after its image was downloaded and checked.
+type Prefetched struct {
+	Submission reddit.Submission
+	Width      int
+	Height     int
+	Err        error
+
+	image image.Image // nil when the image came from the cache
+}
+
+// Post makes the post of p, decoding the image if it came from the
+// cache. A cached image another process removed meanwhile is
+// downloaded again.
+func (pl *Pipeline) Post(ctx context.Context, p *Prefetched) (*publish.Post, error) {
+	if p.Err != nil {
+		return nil, p.Err
+	}
+	if p.image == nil {
+		data, err := pl.Store.GetStateData(prefetchDataKey(p.Submission.ID))
+		if err != nil {
+			if _, p.image, err = pl.prefetchImage(ctx, p.Submission); err != nil {
+				ie, _ := imageError(err)
+				return nil, ie
+			}
+		} else if p.image, err = photo.Decode(data, pl.Limits); err != nil {
+			return nil, err
+		}
+	}
+	return &publish.Post{
+		Image:      p.image,
+		Caption:    pl.Caption(p.Submission),
+		Submission: p.Submission,
+	}, nil
+}
+
+// PrefetchImages downloads the images of ss with at most Workers
+// requests at a time and checks them against the Rules. The result
+// keeps the order of ss. Images downloaded by earlier runs are reused,
+// unless their file is gone.
+func (pl *Pipeline) PrefetchImages(ctx context.Context, ss []reddit.Submission) ([]*Prefetched, error) {
+	st := pl.Store
+	var idx prefetchIndex
+	if err := st.GetState(prefetchKey, &idx); err != nil {
+		return nil, err
+	}
+	// what this run learned, merged into the index saved
+	// by other processes in the meantime
+	found := map[string]*prefetchEntry{}
+	posted, err := st.Records()
+	if err != nil {
+		return nil, err
+	}
+	workers := pl.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]*Prefetched, len(ss))
+	jobs := make(chan int)
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex // guards found
+	)
+	for w := 0; w < workers && w < len(ss); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				s := ss[i]
+				p := &Prefetched{Submission: s}
+				e := idx.Entries[s.ID]
+				if e == nil || e.stale(pl.Limits) || e.Rule == "" && !st.HasState(prefetchDataKey(s.ID)) {
+					var err error
+					e, p.image, err = pl.prefetchImage(ctx, s)
+					if err != nil {
+						ie, permanent := imageError(err)
+						if !permanent {
+							// a later run tries again
+							p.Err = ie
+							results[i] = p
+							continue
+						}
+						e = &prefetchEntry{Time: time.Now(), Rule: ie.Rule, Reason: ie.Reason}
+						switch err := err.(type) {
+						case *photo.SizeError:
+							e.Limit = err.Max
+						case *photo.PixelError:
+							e.Width, e.Height, e.Limit = err.Width, err.Height, int64(err.Max)
+						}
+					}
+					mu.Lock()
+					found[s.ID] = e
+					mu.Unlock()
+				}
+				p.Width, p.Height = e.Width, e.Height
+				p.Err = pl.Rules.check(pl.Limits, posted, e)
+				results[i] = p
+			}
+		}()
+	}
+feed:
+	for i := range ss {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	for i, p := range results {
+		if p == nil {
+			results[i] = &Prefetched{Submission: ss[i], Err: &ImageError{Rule: "fetch", Reason: ctx.Err().Error()}}
+		}
+	}
+	if err := savePrefetchIndex(st, found); err != nil {
+		log.Printf("failed to save the prefetched images: %v", err)
+	}
+	return results, nil
+}
+
+// Aspects returns the aspect ratios, width over height, of the images
+// downloaded by this and earlier runs, keyed by submission id.
+func (pl *Pipeline) Aspects() (map[string]float64, error) {
+	var idx prefetchIndex
+	if err := pl.Store.GetState(prefetchKey, &idx); err != nil {
+		return nil, err
+	}
+	out := map[string]float64{}
+	for id, e := range idx.Entries {
+		if e.Width > 0 && e.Height > 0 {
+			out[id] = float64(e.Width) / float64(e.Height)
+		}
+	}
+	return out, nil
+}
+
+func (pl *Pipeline) prefetchImage(ctx context.Context, s reddit.Submission) (*prefetchEntry, image.Image, error) {
+	ictx, cancel := withTimeout(ctx, pl.ImageTimeout)
+	data, err := photo.Download(ictx, pl.client(), s.URL, pl.Limits)
+	cancel()
+	if err != nil {
+		return nil, nil, err
+	}
+	im, err := photo.Decode(data, pl.Limits)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := pl.Store.PutStateData(prefetchDataKey(s.ID), data); err != nil {
+		return nil, nil, err
+	}
+	b := im.Bounds()
+	return &prefetchEntry{Time: time.Now(), Width: b.Dx(), Height: b.Dy(), Hash: photo.Hash(im)}, im, nil
+}
+
+// imageError names the rule a failed download or decoding broke,
+// and whether a later run would get the same answer. Size and pixel
+// rejections are kept until the limit is raised.
+func imageError(err error) (ie *ImageError, permanent bool) {
+	switch e := err.(type) {
+	case *photo.StatusError:
+		return &ImageError{Rule: "status", Reason: e.Error()}, !e.Temporary()
+	case *photo.ContentTypeError:
+		return &ImageError{Rule: "content type", Reason: e.Error()}, true
+	case *photo.SizeError:
+		return &ImageError{Rule: "size", Reason: e.Error()}, true
+	case *photo.PixelError:
+		return &ImageError{Rule: "pixels", Reason: e.Error()}, true
+	case *photo.FormatError:
+		return &ImageError{Rule: "format", Reason: e.Error()}, true
+	}
+	return &ImageError{Rule: "fetch", Reason: err.Error()}, false
+}
+
+// savePrefetchIndex adds the entries found to the index under the store
+// lock, and drops images and rejections that expired or were posted since.
+func savePrefetchIndex(st *store.Store, found map[string]*prefetchEntry) error {
+	unlock, err := st.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	var idx prefetchIndex
+	if err := st.GetState(prefetchKey, &idx); err != nil {
+		return err
+	}
+	if idx.Entries == nil {
+		idx.Entries = map[string]*prefetchEntry{}
+	}
+	for id, e := range found {
+		idx.Entries[id] = e
+	}
+	for id, e := range idx.Entries {
+		if time.Since(e.Time) < prefetchTTL && !st.Has(id) {
+			continue
+		}
+		delete(idx.Entries, id)
+		if err := st.RemoveState(prefetchDataKey(id)); err != nil {
+			log.Printf("failed to remove the prefetched image of %s: %v", id, err)
+		}
+	}
+	return st.PutState(prefetchKey, &idx)
+}
+
+// ImageRules are checked once an image is downloaded. 0 is no limit,
+// aspect ratios are width over height.
+type ImageRules struct {
+	MinWidth  int
+	MinHeight int
+	MinAspect float64
+	MaxAspect float64
+	// DuplicateDistance is how many bits the hash of an image may differ
+	// from a posted one and still count as the same, 0 for exact copies.
+	DuplicateDistance int
+}
+
+// check applies the rules and rejects images already posted under
+// another submission. Cached images are held to the current
+// MaxPixels as well.
+func (ir *ImageRules) check(lim photo.Limits, posted []*store.Record, e *prefetchEntry) error {
+	if e.Rule != "" {
+		return &ImageError{Rule: e.Rule, Reason: e.Reason}
+	}
+	if max := lim.MaxPixels; max > 0 && e.Width*e.Height > max {
+		return &ImageError{Rule: "pixels", Reason: (&photo.PixelError{Width: e.Width, Height: e.Height, Max: max}).Error()}
+	}
+	if e.Width < ir.MinWidth || e.Height < ir.MinHeight {
+		return &ImageError{Rule: "resolution", Reason: fmt.Sprintf("%dx%d is below %dx%d", e.Width, e.Height, ir.MinWidth, ir.MinHeight)}
+	}
+	if e.Height > 0 {
+		ratio := float64(e.Width) / float64(e.Height)
+		if ir.MinAspect > 0 && ratio < ir.MinAspect {
+			return &ImageError{Rule: "aspect", Reason: fmt.Sprintf("aspect ratio %.2f is below %g", ratio, ir.MinAspect)}
+		}
+		if ir.MaxAspect > 0 && ratio > ir.MaxAspect {
+			return &ImageError{Rule: "aspect", Reason: fmt.Sprintf("aspect ratio %.2f is above %g", ratio, ir.MaxAspect)}
+		}
+	}
+	for _, r := range posted {
+		if r.ImageHash != 0 && photo.Distance(r.ImageHash, e.Hash) <= ir.DuplicateDistance {
+			return &ImageError{Rule: "duplicate", Reason: fmt.Sprintf("same image as %s posted on %s", r.ID, r.Posted.Format("2006-01-02"))}
+		}
+	}
+	return nil
+}
+
+// Batch is the number of the n candidates prefetched at a time.
+func (pl *Pipeline) Batch(n int) int {
+	if pl.Prefetch < 1 {
+		return 1
+	}
+	if pl.Prefetch < n {
+		return pl.Prefetch
+	}
+	return n
+}
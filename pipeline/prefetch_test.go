@@ -0,0 +1,271 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
+)
+
+// imageStub serves a 90x60 JPEG for every submission in place of Reddit.
+type imageStub struct {
+	images map[string][]byte // by url
+
+	mu   sync.Mutex
+	hits map[string]int // requests by url
+}
+
+func (is *imageStub) RoundTrip(req *http.Request) (*http.Response, error) {
+	is.mu.Lock()
+	is.hits[req.URL.String()]++
+	is.mu.Unlock()
+	data := is.images[req.URL.String()]
+	status := http.StatusOK
+	if data == nil {
+		status = http.StatusNotFound
+	}
+	return &http.Response{
+		Status:        http.StatusText(status),
+		StatusCode:    status,
+		Header:        http.Header{"Content-Type": {"image/jpeg"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}, nil
+}
+
+func (is *imageStub) requests(url string) int {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	return is.hits[url]
+}
+
+// testJPEG is an image with a pattern of its own for every seed,
+// so their hashes differ.
+func testJPEG(seed int) []byte {
+	im := image.NewRGBA(image.Rect(0, 0, 90, 60))
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 90; x++ {
+			v := uint8((x*(seed+2)*29 + y*(seed+5)*13) % 251)
+			im.Set(x, y, color.RGBA{v, 255 - v, uint8(seed * 40), 255})
+		}
+	}
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, im, nil)
+	return buf.Bytes()
+}
+
+func newTestPipeline(t *testing.T) (*Pipeline, *imageStub, []reddit.Submission) {
+	is := &imageStub{images: map[string][]byte{}, hits: map[string]int{}}
+	var ss []reddit.Submission
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("post%d", i+1)
+		url := "https://i.redd.it/" + id + ".jpg"
+		ss = append(ss, reddit.Submission{ID: id, Title: fmt.Sprintf("Post number %d", i+1), URL: url})
+		is.images[url] = testJPEG(i)
+	}
+	pl := &Pipeline{
+		Store:    store.New(t.TempDir()),
+		Client:   &http.Client{Transport: is},
+		Workers:  2,
+		Prefetch: 2,
+	}
+	return pl, is, ss
+}
+
+// A size or pixels rejection is kept, until the limit is raised.
+func TestPrefetchRejectionCached(t *testing.T) {
+	pl, is, ss := newTestPipeline(t)
+	for _, tt := range []struct {
+		name      string
+		maxBytes  int64
+		maxPixels int
+		rule      string // "" when it passes
+		requests  int    // so far
+	}{
+		{"too many pixels", 0, 1000, "pixels", 1},
+		{"cached", 0, 1000, "pixels", 1},
+		{"raised", 0, 5000, "pixels", 2},
+		{"passes", 0, 0, "", 3},
+		{"image cached", 0, 0, "", 3},
+		// the cached image has 90x60 pixels
+		{"lowered", 0, 1000, "pixels", 3},
+	} {
+		pl.Limits.MaxBytes, pl.Limits.MaxPixels = tt.maxBytes, tt.maxPixels
+		pp, err := pl.PrefetchImages(context.Background(), ss[:1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		rule := ""
+		if ie, ok := pp[0].Err.(*ImageError); ok {
+			rule = ie.Rule
+		} else if pp[0].Err != nil {
+			t.Fatalf("%s: %v", tt.name, pp[0].Err)
+		}
+		if rule != tt.rule {
+			t.Errorf("%s: rule %q, want %q", tt.name, rule, tt.rule)
+		}
+		if n := is.requests(ss[0].URL); n != tt.requests {
+			t.Errorf("%s: %d downloads, want %d", tt.name, n, tt.requests)
+		}
+	}
+}
+
+func TestPrefetchSizeCached(t *testing.T) {
+	pl, is, ss := newTestPipeline(t)
+	pl.Limits.MaxBytes = 100
+	for i := 0; i < 2; i++ {
+		pp, err := pl.PrefetchImages(context.Background(), ss[:1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ie, ok := pp[0].Err.(*ImageError); !ok || ie.Rule != "size" {
+			t.Fatalf("got %v, want a size rejection", pp[0].Err)
+		}
+	}
+	if n := is.requests(ss[0].URL); n != 1 {
+		t.Errorf("%d downloads, want 1", n)
+	}
+}
+
+func TestPrefetchImageRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules ImageRules
+		rule  string
+	}{
+		{"none", ImageRules{}, ""},
+		{"resolution", ImageRules{MinWidth: 100}, "resolution"},
+		{"too narrow", ImageRules{MinAspect: 2}, "aspect"},
+		{"too wide", ImageRules{MaxAspect: 1}, "aspect"},
+		{"in range", ImageRules{MinAspect: 1, MaxAspect: 2}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl, _, ss := newTestPipeline(t)
+			pl.Rules = tt.rules
+			pp, err := pl.PrefetchImages(context.Background(), ss[:1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			rule := ""
+			if ie, ok := pp[0].Err.(*ImageError); ok {
+				rule = ie.Rule
+			}
+			if rule != tt.rule {
+				t.Errorf("rule %q, want %q: %v", rule, tt.rule, pp[0].Err)
+			}
+		})
+	}
+}
+
+// An image that fails to decode from the cache is skipped for the next one.
+func TestMakePostSkipsBadCache(t *testing.T) {
+	pl, _, ss := newTestPipeline(t)
+	if _, err := pl.PrefetchImages(context.Background(), ss); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 200, 200)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.Store.PutStateData(prefetchDataKey("post1"), buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	pl.Limits.MaxPixels = 10000
+	p, err := pl.MakePost(context.Background(), ss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Submission.ID != "post2" {
+		t.Errorf("got %s, want post2", p.Submission.ID)
+	}
+}
+
+// A cached image whose file is gone is downloaded again, whether it
+// went missing before prefetching or between prefetching and posting.
+func TestPrefetchMissingImage(t *testing.T) {
+	pl, is, ss := newTestPipeline(t)
+	ctx := context.Background()
+	if _, err := pl.PrefetchImages(ctx, ss[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.Store.RemoveState(prefetchDataKey(ss[0].ID)); err != nil {
+		t.Fatal(err)
+	}
+	pp, err := pl.PrefetchImages(ctx, ss[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := is.requests(ss[0].URL); n != 2 {
+		t.Errorf("%d downloads, want 2", n)
+	}
+	if pp, err = pl.PrefetchImages(ctx, ss[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.Store.RemoveState(prefetchDataKey(ss[0].ID)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pl.Post(ctx, pp[0]); err != nil {
+		t.Fatal(err)
+	}
+	if n := is.requests(ss[0].URL); n != 3 {
+		t.Errorf("%d downloads, want 3", n)
+	}
+}
+
+// Runs on the same store at once keep each other's entries.
+func TestPrefetchIndexConcurrent(t *testing.T) {
+	pl, _, ss := newTestPipeline(t)
+	dir := t.TempDir()
+	pl.Store = store.New(dir)
+	var wg sync.WaitGroup
+	for _, s := range ss {
+		wg.Add(1)
+		go func(s reddit.Submission) {
+			defer wg.Done()
+			// a store of its own, like another process would have
+			other := *pl
+			other.Store = store.New(dir)
+			if _, err := other.PrefetchImages(context.Background(), []reddit.Submission{s}); err != nil {
+				t.Error(err)
+			}
+		}(s)
+	}
+	wg.Wait()
+	var idx prefetchIndex
+	if err := pl.Store.GetState(prefetchKey, &idx); err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Entries) != len(ss) {
+		t.Errorf("%d entries in the index, want %d", len(idx.Entries), len(ss))
+	}
+}
+
+func TestCaption(t *testing.T) {
+	s := reddit.Submission{ID: "post1", Title: "Funny cat in a box"}
+	for _, style := range CaptionStyles {
+		pl := &Pipeline{CaptionStyle: style}
+		c := pl.Caption(s)
+		if style == "title" && c != s.Title {
+			t.Errorf("%s: caption %q", style, c)
+		}
+		// without hashtags the title is used
+		if style == "title+hashtags" && !strings.HasPrefix(c, s.Title) {
+			t.Errorf("%s: caption %q", style, c)
+		}
+		if c == "" {
+			t.Errorf("%s: empty caption", style)
+		}
+	}
+}
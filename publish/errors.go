@@ -0,0 +1,216 @@
+package publish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ahmdrz/goinsta"
+)
+
+type ErrorClass int
+
+const (
+	ErrUnknown ErrorClass = iota
+	// ErrTransient errors are worth retrying after a while.
+	ErrTransient
+	// ErrCheckpoint means a human has to look at the account, because
+	// instagram asks for a checkpoint or refuses the login.
+	ErrCheckpoint
+	// ErrPermanent errors will not go away by retrying the same post.
+	// Errors that are not recognized are permanent, so an upload that
+	// may have gone through is never sent twice.
+	ErrPermanent
+	// ErrInterrupted means the context ended while a request was in
+	// flight, so it is unknown whether the post went through.
+	ErrInterrupted
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrTransient:
+		return "transient"
+	case ErrCheckpoint:
+		return "checkpoint"
+	case ErrPermanent:
+		return "permanent"
+	case ErrInterrupted:
+		return "interrupted"
+	default:
+		return "unknown"
+	}
+}
+
+var checkpointMarkers = []string{
+	"checkpoint",
+	"challenge",
+	"feedback_required",
+	"feedback required",
+	"sentry_block",
+}
+
+var transientMarkers = []string{
+	"rate_limit",
+	"please wait a few minutes",
+	"try again later",
+}
+
+func containsAny(s string, markers []string) bool {
+	s = strings.ToLower(s)
+	for _, m := range markers {
+		if strings.Contains(s, m) {
+			return true
+		}
+	}
+	return false
+}
+
+func ClassifyError(err error) ErrorClass {
+	switch e := err.(type) {
+	case nil:
+		return ErrUnknown
+	case *UploadError:
+		return e.Class
+	case *StatusError:
+		switch {
+		case e.Account != nil && ClassifyError(e.Account) == ErrCheckpoint:
+			return ErrCheckpoint
+		case e.Code == http.StatusTooManyRequests || e.Code >= 500:
+			return ErrTransient
+		default:
+			return ErrPermanent
+		}
+	case goinsta.Error503:
+		return ErrTransient
+	case goinsta.Error400:
+		return classifyMessage(e.Payload.Message + " " + e.Status)
+	case goinsta.ErrorN:
+		return classifyMessage(e.ErrorType + " " + e.Message)
+	case *webhookError:
+		if e.Status >= 500 || e.Status == http.StatusTooManyRequests {
+			return ErrTransient
+		}
+		return ErrPermanent
+	case net.Error:
+		var oe *net.OpError
+		if errors.As(err, &oe) && (oe.Op == "dial" || oe.Op == "proxyconnect") {
+			// the request never left
+			return ErrTransient
+		}
+		return ErrInterrupted
+	}
+	return ErrPermanent
+}
+
+func classifyMessage(msg string) ErrorClass {
+	switch {
+	case containsAny(msg, checkpointMarkers):
+		return ErrCheckpoint
+	case containsAny(msg, transientMarkers):
+		return ErrTransient
+	default:
+		return ErrPermanent
+	}
+}
+
+// goinsta reports a bad status of upload/photo/ as a plain error
+// and drops the response body.
+var reUploadStatus = regexp.MustCompile(`^invalid status code, result: (\d{3})`)
+
+// StatusError is a bad HTTP status from the photo upload. As the body
+// with the reason is lost, Account holds the error of a follow-up
+// request about the account, which tells a checkpoint apart.
+type StatusError struct {
+	Code    int
+	Err     error
+	Account error
+}
+
+func (e *StatusError) Error() string {
+	if e.Account != nil {
+		return fmt.Sprintf("%v, account: %v", e.Err, e.Account)
+	}
+	return e.Err.Error()
+}
+
+// uploadStatusError returns the StatusError of a goinsta upload error, or nil.
+func uploadStatusError(err error) *StatusError {
+	if err == nil {
+		return nil
+	}
+	m := reUploadStatus.FindStringSubmatch(err.Error())
+	if m == nil {
+		return nil
+	}
+	code, _ := strconv.Atoi(m[1])
+	return &StatusError{Code: code, Err: err}
+}
+
+type UploadError struct {
+	Op    string
+	Class ErrorClass
+	Err   error
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("failed to %s (%v): %v", e.Op, e.Class, e.Err)
+}
+
+// Retry says how often transient errors are retried and how long
+// to wait before the first retry, the wait doubles every time.
+type Retry struct {
+	Attempts int
+	Backoff  time.Duration
+}
+
+// Do calls f until it succeeds, fails with a non transient error,
+// runs out of attempts or ctx is done.
+func (r Retry) Do(ctx context.Context, op string, f func() error) error {
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return &UploadError{Op: op, Class: ErrTransient, Err: err}
+		}
+		err := interruptible(ctx, f)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return &UploadError{Op: op, Class: ErrInterrupted, Err: ctx.Err()}
+		}
+		class := ClassifyError(err)
+		if class != ErrTransient || attempt >= r.Attempts {
+			if ue, ok := err.(*UploadError); ok {
+				return ue
+			}
+			return &UploadError{Op: op, Class: class, Err: err}
+		}
+		wait := r.Backoff << uint(attempt)
+		log.Printf("%s failed (%v), retrying in %v", op, err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// interruptible runs f, which may not know about contexts, and returns
+// ctx.Err() as soon as ctx ends. f is left running in the background.
+func interruptible(ctx context.Context, f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,152 @@
+package publish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/LamaLamer/redigram/fakeinsta"
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/ahmdrz/goinsta"
+)
+
+func TestClassifyError(t *testing.T) {
+	checkpoint := goinsta.Error400{}
+	checkpoint.Payload.Message = "challenge_required"
+	badRequest := goinsta.Error400{}
+	badRequest.Payload.Message = "media_needs_reupload"
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	read := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	tests := []struct {
+		err  error
+		want ErrorClass
+	}{
+		{nil, ErrUnknown},
+		{errors.New("something odd"), ErrPermanent},
+		{fmt.Errorf("unknown error, status: fail"), ErrPermanent},
+		{&UploadError{Op: "x", Class: ErrInterrupted, Err: errors.New("x")}, ErrInterrupted},
+		{goinsta.Error503{}, ErrTransient},
+		{checkpoint, ErrCheckpoint},
+		{badRequest, ErrPermanent},
+		{goinsta.ErrorN{Message: "Please wait a few minutes before you try again."}, ErrTransient},
+		{goinsta.ErrorN{Message: "feedback_required"}, ErrCheckpoint},
+		{&webhookError{Status: 502}, ErrTransient},
+		{&webhookError{Status: 422}, ErrPermanent},
+		{dial, ErrTransient},
+		{read, ErrInterrupted},
+		{&StatusError{Code: 503}, ErrTransient},
+		{&StatusError{Code: 429}, ErrTransient},
+		{&StatusError{Code: 400}, ErrPermanent},
+		{&StatusError{Code: 400, Account: checkpoint}, ErrCheckpoint},
+		{&StatusError{Code: 503, Account: goinsta.Error503{}}, ErrTransient},
+	}
+	for _, tt := range tests {
+		if got := ClassifyError(tt.err); got != tt.want {
+			t.Errorf("ClassifyError(%#v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestUploadStatusError(t *testing.T) {
+	if se := uploadStatusError(errors.New("invalid status code, result: 400 Bad Request")); se == nil || se.Code != 400 {
+		t.Errorf("got %#v, want code 400", se)
+	}
+	if se := uploadStatusError(errors.New("unknown error, status: fail")); se != nil {
+		t.Errorf("got %#v, want nil", se)
+	}
+}
+
+func TestRetryDo(t *testing.T) {
+	r := Retry{Attempts: 2, Backoff: time.Millisecond}
+	var calls int
+	err := r.Do(context.Background(), "op", func() error {
+		calls++
+		return goinsta.Error503{}
+	})
+	if calls != 3 || ClassifyError(err) != ErrTransient {
+		t.Errorf("transient: %d calls, %v", calls, err)
+	}
+	calls = 0
+	err = r.Do(context.Background(), "op", func() error {
+		calls++
+		return errors.New("something odd")
+	})
+	if calls != 1 || ClassifyError(err) != ErrPermanent {
+		t.Errorf("unknown: %d calls, %v", calls, err)
+	}
+}
+
+func testPost() *Post {
+	return &Post{
+		Image:      image.NewRGBA(image.Rect(0, 0, 40, 30)),
+		Caption:    "caption",
+		Submission: reddit.Submission{ID: "abc123", Title: "title"},
+	}
+}
+
+func count(requests []string, endpoint string) int {
+	var n int
+	for _, r := range requests {
+		if r == endpoint {
+			n++
+		}
+	}
+	return n
+}
+
+func TestInstagramPublish(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		faults   []fakeinsta.Fault
+		class    ErrorClass // ErrUnknown for success
+		uploads  int
+	}{
+		{"ok", "", nil, ErrUnknown, 1},
+		{"unavailable then ok", "upload/photo/", []fakeinsta.Fault{fakeinsta.Unavailable}, ErrUnknown, 2},
+		{"rate limited then ok", "media/configure/", []fakeinsta.Fault{fakeinsta.RateLimited}, ErrUnknown, 2},
+		{"checkpoint on upload", "upload/photo/", []fakeinsta.Fault{fakeinsta.Checkpoint}, ErrCheckpoint, 1},
+		{"checkpoint on configure", "media/configure/", []fakeinsta.Fault{fakeinsta.Checkpoint}, ErrCheckpoint, 1},
+		{"bad request", "media/configure/", []fakeinsta.Fault{fakeinsta.BadRequest}, ErrPermanent, 1},
+		{"unknown upload status", "upload/photo/", []fakeinsta.Fault{{Status: 200, Body: `{"status":"fail"}`}}, ErrPermanent, 1},
+		{"bad password", "accounts/login/", []fakeinsta.Fault{fakeinsta.BadPassword}, ErrCheckpoint, 0},
+		{"unavailable", "upload/photo/", []fakeinsta.Fault{fakeinsta.Unavailable, fakeinsta.Unavailable, fakeinsta.Unavailable}, ErrTransient, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fakeinsta.NewServer()
+			defer srv.Close()
+			if tt.endpoint != "" {
+				srv.Fail(tt.endpoint, tt.faults...)
+			}
+			ig := &Instagram{
+				Username: "user",
+				Password: "pass",
+				Proxy:    srv.ProxyURL(),
+				Insecure: true,
+				Retry:    Retry{Attempts: 2, Backoff: time.Millisecond},
+			}
+			res, err := ig.Publish(context.Background(), testPost())
+			if got := ClassifyError(err); got != tt.class {
+				t.Fatalf("class %v, want %v: %v", got, tt.class, err)
+			}
+			if n := count(srv.Requests(), "upload/photo/"); n != tt.uploads {
+				t.Errorf("%d uploads, want %d", n, tt.uploads)
+			}
+			mm := srv.Media()
+			if tt.class != ErrUnknown {
+				if len(mm) != 0 {
+					t.Errorf("%d media published", len(mm))
+				}
+				return
+			}
+			if len(mm) != 1 || res.ID != mm[0].ID || mm[0].Caption != "caption" {
+				t.Errorf("result %+v, media %+v", res, mm)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package publish
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/ahmdrz/goinsta"
+)
+
+// Instagram uploads with the credentials of an account.
+type Instagram struct {
+	Username string
+	Password string
+	// Proxy and Insecure point goinsta at another server, like fakeinsta.
+	Proxy    string
+	Insecure bool
+	Retry    Retry
+}
+
+// Login logs the account in, retrying transient failures.
+// goinsta can not be canceled, Login returns when ctx ends
+// but the request may still complete in the background.
+// A refused login is a checkpoint: it is the account that
+// needs attention, not the post.
+func (ig *Instagram) Login(ctx context.Context) (*goinsta.Instagram, error) {
+	insta := goinsta.New(ig.Username, ig.Password)
+	if ig.Proxy != "" {
+		if err := insta.SetProxy(ig.Proxy, ig.Insecure); err != nil {
+			return nil, err
+		}
+	}
+	err := ig.Retry.Do(ctx, "login", func() error {
+		err := insta.Login()
+		if ClassifyError(err) == ErrInterrupted {
+			// logging in twice does no harm
+			return &UploadError{Op: "login", Class: ErrTransient, Err: err}
+		}
+		return err
+	})
+	if ue, ok := err.(*UploadError); ok {
+		switch ue.Class {
+		case ErrInterrupted:
+			// nothing is published by logging in
+			ue.Class = ErrTransient
+		case ErrPermanent:
+			ue.Class = ErrCheckpoint
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return insta, nil
+}
+
+func (ig *Instagram) Name() string {
+	return "instagram"
+}
+
+func (ig *Instagram) Publish(ctx context.Context, p *Post) (*Result, error) {
+	data, err := encodeJPEG(p)
+	if err != nil {
+		return nil, err
+	}
+	insta, err := ig.Login(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// an interrupted upload may still be using the session
+		if ctx.Err() == nil {
+			insta.Logout()
+		}
+	}()
+	var item goinsta.Item
+	err = ig.Retry.Do(ctx, "upload", func() error {
+		var err error
+		item, err = insta.UploadPhoto(bytes.NewReader(data), p.Caption, 87, 0)
+		if se := uploadStatusError(err); se != nil {
+			se.Account = insta.Account.Sync()
+			return se
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Result{ID: item.ID, Code: item.Code}, nil
+}
+
+// DeleteMedia removes a published post. FeedMedia.Delete
+// ignores errors, so the item is deleted directly.
+func DeleteMedia(insta *goinsta.Instagram, id string) error {
+	media, err := insta.GetMedia(id)
+	if err != nil {
+		return err
+	}
+	if len(media.Items) == 0 {
+		return fmt.Errorf("instagram media %s not found", id)
+	}
+	return media.Items[0].Delete()
+}
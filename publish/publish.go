@@ -0,0 +1,231 @@
+// Package publish sends finished posts to Instagram and other destinations.
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/LamaLamer/redigram/photo"
+	"github.com/LamaLamer/redigram/reddit"
+)
+
+// Post is an image ready to be published with its caption and source.
+type Post struct {
+	Image      image.Image
+	Caption    string
+	Submission reddit.Submission
+}
+
+func (p Post) String() string {
+	return fmt.Sprintf("Title: %s, Caption: %s", p.Submission.Title, p.Caption)
+}
+
+// Publisher is a destination for finished posts.
+type Publisher interface {
+	Name() string
+	Publish(ctx context.Context, p *Post) (*Result, error)
+}
+
+// Result is kept in the store for every publisher a post went to.
+type Result struct {
+	Publisher string    `json:"publisher"`
+	Time      time.Time `json:"time"`
+	ID        string    `json:"id,omitempty"`
+	Code      string    `json:"code,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Publish sends p to every publisher and returns the result of each one
+// together with the first error encountered.
+func Publish(ctx context.Context, pubs []Publisher, p *Post) ([]*Result, error) {
+	var (
+		results  []*Result
+		firstErr error
+	)
+	for _, pub := range pubs {
+		res, err := pub.Publish(ctx, p)
+		if res == nil {
+			res = &Result{}
+		}
+		res.Publisher = pub.Name()
+		res.Time = time.Now()
+		if err != nil {
+			res.Error = err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		results = append(results, res)
+	}
+	return results, firstErr
+}
+
+func encodeJPEG(p *Post) ([]byte, error) {
+	data, err := photo.EncodeJPEG(p.Image)
+	if err != nil {
+		return nil, &UploadError{Op: "encode", Class: ErrPermanent, Err: err}
+	}
+	return data, nil
+}
+
+// Outbox writes the image and a JSON sidecar into a directory
+// for some other process to pick up.
+type Outbox struct {
+	Dir string
+}
+
+type outboxSidecar struct {
+	ID        string `json:"id"`
+	Caption   string `json:"caption"`
+	Title     string `json:"title"`
+	Subreddit string `json:"subreddit"`
+	Author    string `json:"author"`
+	Score     int    `json:"score"`
+	URL       string `json:"url"`
+	Permalink string `json:"permalink"`
+	Image     string `json:"image"`
+}
+
+func (op *Outbox) Name() string {
+	return "outbox"
+}
+
+func (op *Outbox) Publish(ctx context.Context, p *Post) (*Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &UploadError{Op: "write outbox", Class: ErrTransient, Err: err}
+	}
+	data, err := encodeJPEG(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(op.Dir, 0755); err != nil {
+		return nil, op.error(err)
+	}
+	s := p.Submission
+	image := filepath.Join(op.Dir, s.ID+".jpeg")
+	if err := ioutil.WriteFile(image, data, 0644); err != nil {
+		return nil, op.error(err)
+	}
+	sidecar, err := json.MarshalIndent(outboxSidecar{
+		ID:        s.ID,
+		Caption:   p.Caption,
+		Title:     s.Title,
+		Subreddit: s.Subreddit,
+		Author:    s.Author,
+		Score:     s.Score,
+		URL:       s.URL,
+		Permalink: s.Permalink,
+		Image:     filepath.Base(image),
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(op.Dir, s.ID+".json"), sidecar, 0644); err != nil {
+		return nil, op.error(err)
+	}
+	return &Result{ID: image}, nil
+}
+
+// error makes a failed write transient, writing the files again does no harm.
+func (op *Outbox) error(err error) error {
+	return &UploadError{Op: "write outbox", Class: ErrTransient, Err: err}
+}
+
+// Webhook POSTs the image and caption as multipart/form-data.
+// A nil Client waits up to 30 seconds for the hook.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+	Retry  Retry
+}
+
+func (wp *Webhook) Name() string {
+	return "webhook"
+}
+
+func (wp *Webhook) Publish(ctx context.Context, p *Post) (*Result, error) {
+	data, err := encodeJPEG(p)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	err = wp.Retry.Do(ctx, "post webhook", func() error {
+		var err error
+		body, err = wp.send(ctx, p, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Result{ID: string(bytes.TrimSpace(body))}, nil
+}
+
+type webhookError struct {
+	Status int
+	Body   string
+}
+
+func (e *webhookError) Error() string {
+	return fmt.Sprintf("webhook returned %d: %s", e.Status, e.Body)
+}
+
+func (wp *Webhook) send(ctx context.Context, p *Post, image []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	s := p.Submission
+	fields := map[string]string{
+		"caption":   p.Caption,
+		"title":     s.Title,
+		"id":        s.ID,
+		"subreddit": s.Subreddit,
+		"permalink": s.Permalink,
+	}
+	for k, v := range fields {
+		if err := w.WriteField(k, v); err != nil {
+			return nil, err
+		}
+	}
+	fw, err := w.CreateFormFile("image", s.ID+".jpeg")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(image); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, wp.URL, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	client := wp.Client
+	if client == nil {
+		client = &http.Client{
+			Timeout: 30 * time.Second,
+		}
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, &webhookError{Status: resp.StatusCode, Body: string(body)}
+	}
+	return body, nil
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/LamaLamer/redigram/photo"
+	"github.com/LamaLamer/redigram/publish"
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
+)
+
+const (
+	QueuePending  = "pending"
+	QueueApproved = "approved"
+	QueueRejected = "rejected"
+	// QueuePublishing is an approved entry a process is publishing.
+	QueuePublishing = "publishing"
+)
+
+// claimGrace is added to the deadlines of a claiming run for
+// what it does besides looking the post up and uploading it.
+const claimGrace = time.Minute
+
+// QueueEntry is a rendered post waiting for a human decision.
+// The image is kept in the store as state "queue-<id>.jpeg".
+type QueueEntry struct {
+	ID         string            `json:"id"`
+	Status     string            `json:"status"`
+	Prepared   time.Time         `json:"prepared"`
+	Decided    time.Time         `json:"decided,omitempty"`
+	Caption    string            `json:"caption"`
+	Submission reddit.Submission `json:"submission"`
+	// Reason tells why a rejected entry was rejected, if anyone said.
+	Reason string `json:"reason,omitempty"`
+
+	// Claimed is when a run began publishing the entry, ClaimExpires
+	// when that run is past its deadlines, zero when it has none.
+	Claimed      time.Time `json:"claimed,omitempty"`
+	ClaimExpires time.Time `json:"claim_expires,omitempty"`
+}
+
+// Queue is stored as state "queue". Published entries leave the queue,
+// rejected ones stay for rejectedKeep so they are not prepared again
+// while they are still in the listing.
+type Queue struct {
+	Entries []*QueueEntry `json:"entries"`
+}
+
+const (
+	queueKey = "queue"
+	// rejectedKeep is how long rejected entries stay in the queue,
+	// long after their submissions dropped out of the listing.
+	rejectedKeep = 7 * 24 * time.Hour
+)
+
+func queueImageKey(id string) string {
+	return "queue-" + id + ".jpeg"
+}
+
+func LoadQueue(st *store.Store) (*Queue, error) {
+	var q Queue
+	if err := st.GetState(queueKey, &q); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// UpdateQueue reloads the queue under the store lock, applies f and
+// saves it, so changes other processes made in the meantime are kept.
+// Rejected entries older than rejectedKeep are dropped on the way.
+func UpdateQueue(st *store.Store, f func(q *Queue) error) error {
+	unlock, err := st.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	q, err := LoadQueue(st)
+	if err != nil {
+		return err
+	}
+	if err := f(q); err != nil {
+		return err
+	}
+	q.dropRejected(time.Now().Add(-rejectedKeep))
+	return st.PutState(queueKey, q)
+}
+
+// dropRejected removes the entries rejected before t.
+func (q *Queue) dropRejected(t time.Time) {
+	kept := q.Entries[:0]
+	for _, e := range q.Entries {
+		if e.Status != QueueRejected || e.Decided.After(t) {
+			kept = append(kept, e)
+		}
+	}
+	q.Entries = kept
+}
+
+func (q *Queue) Get(id string) *QueueEntry {
+	for _, e := range q.Entries {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// Approved returns the approved entries, prepared first to last.
+func (q *Queue) Approved() []*QueueEntry {
+	var ee []*QueueEntry
+	for _, e := range q.Entries {
+		if e.Status == QueueApproved {
+			ee = append(ee, e)
+		}
+	}
+	sort.SliceStable(ee, func(i, j int) bool {
+		return ee[i].Prepared.Before(ee[j].Prepared)
+	})
+	return ee
+}
+
+func (q *Queue) Remove(id string) {
+	for i, e := range q.Entries {
+		if e.ID == id {
+			q.Entries = append(q.Entries[:i], q.Entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// RunPrepare renders the top candidates into the approval queue.
+func RunPrepare(ctx context.Context, a *Account, n int) error {
+	st := store.New(a.Store)
+	pick, err := ChooseSource(a, st)
+	if err != nil {
+		return err
+	}
+	ss, err := RankedCandidates(ctx, a, st, pick.Source)
+	if err != nil {
+		return err
+	}
+	pl := newPipeline(a, st)
+	var added []*QueueEntry
+	for len(added) < n && len(ss) > 0 {
+		p, err := pl.MakePost(ctx, ss)
+		if err != nil {
+			if len(added) == 0 {
+				return err
+			}
+			log.Print(err)
+			break
+		}
+		for i := range ss {
+			if ss[i].ID == p.Submission.ID {
+				ss = ss[i+1:]
+				break
+			}
+		}
+		data, err := photo.EncodeJPEG(p.Image)
+		if err != nil {
+			return err
+		}
+		if err := st.PutStateData(queueImageKey(p.Submission.ID), data); err != nil {
+			return err
+		}
+		e := &QueueEntry{
+			ID:         p.Submission.ID,
+			Status:     QueuePending,
+			Prepared:   time.Now(),
+			Caption:    p.Caption,
+			Submission: p.Submission,
+		}
+		added = append(added, e)
+	}
+	queued := 0
+	err = UpdateQueue(st, func(q *Queue) error {
+		for _, e := range added {
+			// another process may have prepared it meanwhile
+			if q.Get(e.ID) == nil {
+				q.Entries = append(q.Entries, e)
+				queued++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if queued > 0 && !a.Dry {
+		if err := pick.Record(st); err != nil {
+			return err
+		}
+	}
+	return WriteQueue(os.Stdout, added)
+}
+
+// Decide approves or rejects the entry, reason says why it is
+// rejected. A rejected entry stays in the queue, its image is
+// dropped, so it cannot be approved again. Entries being
+// published are left alone.
+func (q *Queue) Decide(st *store.Store, id, status, reason string) error {
+	e := q.Get(id)
+	if e == nil {
+		return fmt.Errorf("no queued post %q", id)
+	}
+	switch {
+	case e.Status == QueuePublishing:
+		return fmt.Errorf("%s is being published", id)
+	case e.Status == QueueRejected && status != QueueRejected:
+		return fmt.Errorf("%s was rejected", id)
+	}
+	e.Decided = time.Now()
+	e.Status = status
+	if status == QueueRejected {
+		e.Reason = reason
+		if err := st.RemoveState(queueImageKey(id)); err != nil {
+			log.Printf("failed to remove the image of %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+func (q *Queue) SetCaption(id, caption string) error {
+	e := q.Get(id)
+	if e == nil || e.Status == QueueRejected {
+		return fmt.Errorf("no queued post %q", id)
+	}
+	if e.Status == QueuePublishing {
+		return fmt.Errorf("%s is being published", id)
+	}
+	e.Caption = caption
+	return nil
+}
+
+// RunQueue lists the queue or applies a decision to entries.
+func RunQueue(a *Account, cmd string, args []string) error {
+	st := store.New(a.Store)
+	switch cmd {
+	case "queue":
+		q, err := LoadQueue(st)
+		if err != nil {
+			return err
+		}
+		return WriteQueue(os.Stdout, q.Entries)
+	case "edit-caption":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: edit-caption <id> <caption>")
+		}
+		return UpdateQueue(st, func(q *Queue) error {
+			return q.SetCaption(args[0], args[1])
+		})
+	case "approve":
+		return decideQueued(st, args, QueueApproved, "")
+	case "reject":
+		return RejectQueued(a, args, "")
+	}
+	return fmt.Errorf("unknown queue command %q", cmd)
+}
+
+// RejectQueued rejects the queue entries ids for reason, which may be empty.
+func RejectQueued(a *Account, ids []string, reason string) error {
+	return decideQueued(store.New(a.Store), ids, QueueRejected, reason)
+}
+
+func decideQueued(st *store.Store, ids []string, status, reason string) error {
+	if len(ids) == 0 {
+		if status == QueueRejected {
+			return fmt.Errorf("usage: reject [-reason text] <id>...")
+		}
+		return fmt.Errorf("usage: approve <id>...")
+	}
+	return UpdateQueue(st, func(q *Queue) error {
+		for _, id := range ids {
+			if err := q.Decide(st, id, status, reason); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func WriteQueue(out io.Writer, entries []*QueueEntry) error {
+	entries = append([]*QueueEntry(nil), entries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Prepared.Before(entries[j].Prepared)
+	})
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tPREPARED\tSUB\tSCORE\tCAPTION")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\tr/%s\t%d\t%s\n", e.ID, e.Status,
+			e.Prepared.Format("2006-01-02 15:04"), e.Submission.Subreddit, e.Submission.Score,
+			strings.Replace(e.Caption, "\n", " ", -1))
+	}
+	return w.Flush()
+}
+
+// PostApproved publishes the oldest approved queue entry. The entry is
+// claimed under the store lock, so no other process publishes it as
+// well, and checked again first: it may have been used, its author
+// blocklisted or the Reddit post removed since it was approved.
+func PostApproved(ctx context.Context, a *Account, st *store.Store) error {
+	e, err := claimApproved(a, st, claimExpiry(ctx, time.Now()))
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		log.Printf("%s: no approved posts in the queue", a)
+		return nil
+	}
+	perr := postClaimed(ctx, a, st, e)
+	if a.Dry {
+		// leave the queue alone, the entry is still to be published
+		if perr == errDropped {
+			return nil
+		}
+		return perr
+	}
+	done := perr == errDropped || st.Contains(e.Submission)
+	err = UpdateQueue(st, func(q *Queue) error {
+		c := q.Get(e.ID)
+		switch {
+		case c == nil:
+		case done:
+			q.Remove(e.ID)
+		default:
+			// released for a retry
+			c.Status = QueueApproved
+			c.Claimed, c.ClaimExpires = time.Time{}, time.Time{}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if done {
+		if err := st.RemoveState(queueImageKey(e.ID)); err != nil {
+			log.Printf("failed to remove the image of %s: %v", e.ID, err)
+		}
+	}
+	if perr == errDropped {
+		return nil
+	}
+	return perr
+}
+
+// errDropped is returned by postClaimed for an entry that is no longer to be posted.
+var errDropped = errors.New("dropped from the queue")
+
+func postClaimed(ctx context.Context, a *Account, st *store.Store, e *QueueEntry) error {
+	if !a.Dry {
+		if err := checkQuota(a, st, e.Submission.Subreddit); err != nil {
+			return err
+		}
+	}
+	ss, err := fetchByID(ctx, []string{e.ID})
+	if err != nil {
+		return err
+	}
+	for _, s := range ss {
+		if reason := s.Removed(); reason != "" {
+			log.Printf("%s: dropped %s from the queue, reddit: %s", a, e.ID, reason)
+			return errDropped
+		}
+	}
+	data, err := st.GetStateData(queueImageKey(e.ID))
+	if err != nil {
+		log.Printf("%s: dropped %s from the queue: %v", a, e.ID, err)
+		return errDropped
+	}
+	im, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("%s: dropped %s from the queue: %v", a, e.ID, err)
+		return errDropped
+	}
+	p := &publish.Post{Image: im, Caption: e.Caption, Submission: e.Submission}
+	return PublishPost(ctx, a, st, p)
+}
+
+// claimExpiry is when a run with ctx that claims an entry at now is
+// past its deadlines: the run deadline, or else the Reddit lookup and
+// upload deadlines of the settings. It is zero, the claim is never
+// released, when the run may go on for ever.
+func claimExpiry(ctx context.Context, now time.Time) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline.Add(claimGrace)
+	}
+	lt, ut := settings.ListingTimeout.Duration, settings.UploadTimeout.Duration
+	if lt <= 0 || ut <= 0 {
+		return time.Time{}
+	}
+	return now.Add(lt + ut + claimGrace)
+}
+
+// claimApproved marks the oldest approved entry that can still be
+// posted as publishing and returns a copy of it. Entries that were
+// used, whose author was blocklisted or whose image is gone are
+// dropped on the way. Claims that expired, left behind by processes
+// that died, are cleared first. A dry run only picks the entry.
+func claimApproved(a *Account, st *store.Store, expires time.Time) (*QueueEntry, error) {
+	var bl Blocklist
+	if err := st.GetState(blocklistKey, &bl); err != nil {
+		return nil, err
+	}
+	var claimed *QueueEntry
+	var dropped []string
+	err := UpdateQueue(st, func(q *Queue) error {
+		for _, e := range q.Entries {
+			if e.Status != QueuePublishing {
+				continue
+			}
+			switch {
+			case st.Contains(e.Submission):
+				dropped = append(dropped, e.ID)
+			case !e.ClaimExpires.IsZero() && time.Now().After(e.ClaimExpires):
+				e.Status = QueueApproved
+				e.Claimed, e.ClaimExpires = time.Time{}, time.Time{}
+			}
+		}
+		for _, e := range q.Approved() {
+			reason := ""
+			switch {
+			case st.Contains(e.Submission):
+				reason = "already in the store"
+			case bl.Contains(e.Submission.Author):
+				reason = "u/" + e.Submission.Author + " is blocklisted"
+			case !st.HasState(queueImageKey(e.ID)):
+				reason = "its image is missing"
+			}
+			if reason != "" {
+				log.Printf("%s: dropped %s from the queue, %s", a, e.ID, reason)
+				dropped = append(dropped, e.ID)
+				continue
+			}
+			if !a.Dry {
+				e.Status = QueuePublishing
+				e.Claimed, e.ClaimExpires = time.Now(), expires
+			}
+			c := *e
+			claimed = &c
+			break
+		}
+		if a.Dry {
+			dropped = nil
+		}
+		for _, id := range dropped {
+			q.Remove(id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range dropped {
+		st.RemoveState(queueImageKey(id))
+	}
+	return claimed, nil
+}
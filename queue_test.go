@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LamaLamer/redigram/fakeinsta"
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
+)
+
+func TestUpdateQueueConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// a store of its own, like another process would have
+			err := UpdateQueue(store.New(dir), func(q *Queue) error {
+				q.Entries = append(q.Entries, &QueueEntry{ID: fmt.Sprint(i), Status: QueuePending})
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	q, err := LoadQueue(store.New(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Entries) != 20 {
+		t.Errorf("%d entries, want 20", len(q.Entries))
+	}
+}
+
+// queueApproved puts approved entries for the posts of the stub into the queue.
+func queueApproved(t *testing.T, e *testEnv, ss ...reddit.Submission) {
+	for i, s := range ss {
+		if err := e.st.PutStateData(queueImageKey(s.ID), e.reddit.images[s.URL]); err != nil {
+			t.Fatal(err)
+		}
+		err := UpdateQueue(e.st, func(q *Queue) error {
+			q.Entries = append(q.Entries, &QueueEntry{
+				ID:         s.ID,
+				Status:     QueueApproved,
+				Prepared:   time.Now().Add(time.Duration(i) * time.Second),
+				Caption:    s.Title,
+				Submission: s,
+			})
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A decision taken by another process while a post is uploading survives.
+func TestPostApprovedKeepsDecisions(t *testing.T) {
+	e := newTestEnv(t)
+	e.a.Approval = true
+	ss := e.reddit.ss
+	queueApproved(t, e, ss[0], ss[1])
+	e.insta.Fail("media/configure/", fakeinsta.Fault{Delay: 200 * time.Millisecond})
+	go func() {
+		for e.count("media/configure/") == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if err := RunQueue(e.a, "reject", []string{ss[1].ID}); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := DoPost(context.Background(), e.a); err != nil {
+		t.Fatal(err)
+	}
+	q, err := LoadQueue(e.st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Get(ss[0].ID) != nil || !e.st.Has(ss[0].ID) {
+		t.Errorf("%s is still queued or was not posted", ss[0].ID)
+	}
+	if b := q.Get(ss[1].ID); b == nil || b.Status != QueueRejected {
+		t.Fatalf("the rejection of %s was lost: %+v", ss[1].ID, b)
+	}
+	// and nothing is left to post
+	if err := DoPost(context.Background(), e.a); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(e.insta.Media()); n != 1 {
+		t.Errorf("%d posts published", n)
+	}
+}
+
+func TestStoreLock(t *testing.T) {
+	dir := t.TempDir()
+	st := store.New(dir)
+	unlock, err := st.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := store.New(dir).Lock()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		close(locked)
+		unlock()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("the lock was taken twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lock was not released")
+	}
+	if rr, err := st.Records(); err != nil || len(rr) != 0 {
+		t.Errorf("the lock shows up as %d records: %v", len(rr), err)
+	}
+}
+
+// A rejected entry cannot be approved again, and approved entries
+// that can no longer be posted leave the queue instead of blocking it.
+func TestPostApprovedDropsStale(t *testing.T) {
+	e := newTestEnv(t)
+	e.a.Approval = true
+	ss := e.reddit.ss
+	queueApproved(t, e, ss[0], ss[1], ss[2])
+	if err := RunQueue(e.a, "reject", []string{ss[2].ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunQueue(e.a, "approve", []string{ss[2].ID}); err == nil {
+		t.Error("a rejected post was approved again")
+	}
+	if err := e.st.RemoveState(queueImageKey(ss[0].ID)); err != nil {
+		t.Fatal(err)
+	}
+	if err := BlockAuthor(e.st, &BlockedAuthor{Name: ss[1].Author, Time: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := DoPost(context.Background(), e.a); err != nil {
+		t.Fatal(err)
+	}
+	q, err := LoadQueue(e.st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Entries) != 1 || q.Entries[0].ID != ss[2].ID {
+		t.Errorf("queue is %+v, want only the rejected %s", q.Entries, ss[2].ID)
+	}
+	if n := len(e.insta.Media()); n != 0 {
+		t.Errorf("%d posts published", n)
+	}
+}
+
+// Runs of two processes at once publish an approved entry only once.
+func TestPostApprovedClaims(t *testing.T) {
+	e := newTestEnv(t)
+	e.a.Approval = true
+	queueApproved(t, e, e.reddit.ss[0])
+	e.insta.Fail("media/configure/", fakeinsta.Fault{Delay: 100 * time.Millisecond})
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := DoPost(context.Background(), e.a); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(e.insta.Media()); n != 1 {
+		t.Errorf("%d posts published", n)
+	}
+	q, err := LoadQueue(e.st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Entries) != 0 {
+		t.Errorf("%d entries left in the queue", len(q.Entries))
+	}
+}
+
+// Rejections are kept only until their posts are long out of the listing.
+func TestUpdateQueueDropsOldRejections(t *testing.T) {
+	st := store.New(t.TempDir())
+	old := time.Now().Add(-rejectedKeep - time.Hour)
+	err := UpdateQueue(st, func(q *Queue) error {
+		q.Entries = []*QueueEntry{
+			{ID: "old", Status: QueueRejected, Prepared: old, Decided: old},
+			{ID: "recent", Status: QueueRejected, Prepared: old, Decided: time.Now()},
+			{ID: "pending", Status: QueuePending, Prepared: old},
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := LoadQueue(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, e := range q.Entries {
+		ids = append(ids, e.ID)
+	}
+	if fmt.Sprint(ids) != "[recent pending]" {
+		t.Errorf("queue holds %v, want [recent pending]", ids)
+	}
+}
+
+// A claim is only released once the claiming run is past its deadlines,
+// never when it has none.
+func TestClaimExpiry(t *testing.T) {
+	e := newTestEnv(t)
+	ss := e.reddit.ss
+	queueApproved(t, e, ss[0], ss[1])
+	settings.RunTimeout, settings.ListingTimeout, settings.UploadTimeout = Duration{}, Duration{}, Duration{}
+	if exp := claimExpiry(context.Background(), time.Now()); !exp.IsZero() {
+		t.Fatalf("a run without deadlines has a claim expiring at %v", exp)
+	}
+	past := time.Now().Add(-time.Minute)
+	err := UpdateQueue(e.st, func(q *Queue) error {
+		q.Get(ss[0].ID).Status = QueuePublishing
+		q.Get(ss[1].ID).Status = QueuePublishing
+		q.Get(ss[1].ID).ClaimExpires = past
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := claimApproved(e.a, e.st, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == nil || c.ID != ss[1].ID {
+		t.Fatalf("claimed %+v, want the expired claim of %s", c, ss[1].ID)
+	}
+	q, err := LoadQueue(e.st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := q.Get(ss[0].ID).Status; s != QueuePublishing {
+		t.Errorf("the claim without deadline was released to %s", s)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	if exp := claimExpiry(ctx, time.Now()); !exp.After(deadline) {
+		t.Errorf("claim expires at %v, before the run deadline %v", exp, deadline)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/LamaLamer/redigram/store"
+)
+
+// Quota limits how often an account posts. Zero values disable a limit.
+type Quota struct {
+	PerHour int            `json:"per_hour"`
+	PerDay  int            `json:"per_day"`
+	MinGap  Duration       `json:"min_gap"`
+	PerSub  map[string]int `json:"per_sub"` // per rolling day
+}
+
+type QuotaError struct {
+	Reasons []string
+	Next    time.Time
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota reached (%s), next slot at %s",
+		strings.Join(e.Reasons, ", "), e.Next.Format(time.RFC3339))
+}
+
+// Check returns a *QuotaError if posting from subreddit at now
+// would violate the quota given the store history rr.
+func (q *Quota) Check(rr []*store.Record, subreddit string, now time.Time) error {
+	var posted []*store.Record
+	for _, r := range rr {
+		if !r.Dry && r.Status != store.StatusFailed && !r.Posted.IsZero() {
+			posted = append(posted, r)
+		}
+	}
+	qe := &QuotaError{}
+	block := func(reason string, next time.Time) {
+		qe.Reasons = append(qe.Reasons, reason)
+		if next.After(qe.Next) {
+			qe.Next = next
+		}
+	}
+	if q.MinGap.Duration > 0 && len(posted) > 0 {
+		if next := posted[0].Posted.Add(q.MinGap.Duration); now.Before(next) {
+			block(fmt.Sprintf("min gap %v", q.MinGap), next)
+		}
+	}
+	if next, ok := windowSlot(posted, now, time.Hour, q.PerHour); !ok {
+		block(fmt.Sprintf("%d per hour", q.PerHour), next)
+	}
+	if next, ok := windowSlot(posted, now, 24*time.Hour, q.PerDay); !ok {
+		block(fmt.Sprintf("%d per day", q.PerDay), next)
+	}
+	for sub, limit := range q.PerSub {
+		if !strings.EqualFold(sub, subreddit) {
+			continue
+		}
+		var fromSub []*store.Record
+		for _, r := range posted {
+			if strings.EqualFold(r.Subreddit, sub) {
+				fromSub = append(fromSub, r)
+			}
+		}
+		if next, ok := windowSlot(fromSub, now, 24*time.Hour, limit); !ok {
+			block(fmt.Sprintf("%d per day from r/%s", limit, sub), next)
+		}
+	}
+	if len(qe.Reasons) > 0 {
+		return qe
+	}
+	return nil
+}
+
+// windowSlot reports whether fewer than limit records fall in the
+// window ending at now, and if not, when enough of them will have aged out.
+// rr must be sorted most recent first.
+func windowSlot(rr []*store.Record, now time.Time, window time.Duration, limit int) (time.Time, bool) {
+	if limit <= 0 {
+		return time.Time{}, true
+	}
+	n := 0
+	for _, r := range rr {
+		if now.Sub(r.Posted) >= window {
+			break
+		}
+		n++
+	}
+	if n < limit {
+		return time.Time{}, true
+	}
+	return rr[limit-1].Posted.Add(window), false
+}
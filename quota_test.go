@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LamaLamer/redigram/store"
+)
+
+func TestQuotaCheck(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	post := func(sub string, ago time.Duration) *store.Record {
+		return &store.Record{ID: sub + ago.String(), Subreddit: sub, Posted: now.Add(-ago)}
+	}
+	failed := post("memes", time.Minute)
+	failed.Status = store.StatusFailed
+	dry := post("memes", 2*time.Minute)
+	dry.Dry = true
+	tests := []struct {
+		name string
+		q    Quota
+		rr   []*store.Record // most recent first
+		sub  string
+		next time.Time // zero when posting is allowed
+	}{
+		{"no limits", Quota{}, []*store.Record{post("memes", time.Minute)}, "memes", time.Time{}},
+		{"hour full", Quota{PerHour: 2}, []*store.Record{post("memes", 10*time.Minute), post("memes", 40*time.Minute)}, "memes", now.Add(20 * time.Minute)},
+		{"hour has room", Quota{PerHour: 2}, []*store.Record{post("memes", 10*time.Minute), post("memes", 2*time.Hour)}, "memes", time.Time{}},
+		{"window edge", Quota{PerHour: 1}, []*store.Record{post("memes", time.Hour)}, "memes", time.Time{}},
+		{"min gap", Quota{MinGap: Duration{30 * time.Minute}}, []*store.Record{post("memes", 10*time.Minute)}, "memes", now.Add(20 * time.Minute)},
+		{"day full", Quota{PerDay: 3}, []*store.Record{post("memes", time.Hour), post("cats", 5*time.Hour), post("memes", 23*time.Hour)}, "memes", now.Add(time.Hour)},
+		{"failed and dry runs don't count", Quota{PerHour: 1, MinGap: Duration{time.Hour}}, []*store.Record{failed, dry}, "memes", time.Time{}},
+		{"per sub", Quota{PerSub: map[string]int{"memes": 1}}, []*store.Record{post("memes", 2*time.Hour)}, "Memes", now.Add(22 * time.Hour)},
+		{"other sub", Quota{PerSub: map[string]int{"memes": 1}}, []*store.Record{post("memes", 2*time.Hour)}, "cats", time.Time{}},
+		{"latest limit wins", Quota{PerHour: 1, MinGap: Duration{2 * time.Hour}}, []*store.Record{post("memes", 30*time.Minute)}, "memes", now.Add(90 * time.Minute)},
+	}
+	for _, tt := range tests {
+		err := tt.q.Check(tt.rr, tt.sub, now)
+		if tt.next.IsZero() {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		qe, ok := err.(*QuotaError)
+		if !ok {
+			t.Errorf("%s: got %v, want a quota error", tt.name, err)
+			continue
+		}
+		if !qe.Next.Equal(tt.next) {
+			t.Errorf("%s: next slot %v, want %v", tt.name, qe.Next, tt.next)
+		}
+	}
+}
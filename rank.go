@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
+)
+
+// RankByModel reorders ss by predicted engagement, best first,
+// and returns the predictions in the new order. aspects are the known
+// image aspect ratios by submission id.
+func RankByModel(m *Model, ss []reddit.Submission, aspects map[string]float64, now time.Time) []float64 {
+	pred := map[string]float64{}
+	for _, s := range ss {
+		pred[s.ID] = m.Predict(Features(s, aspects[s.ID], now))
+	}
+	sort.SliceStable(ss, func(i, j int) bool {
+		return pred[ss[i].ID] > pred[ss[j].ID]
+	})
+	out := make([]float64, len(ss))
+	for i, s := range ss {
+		out[i] = pred[s.ID]
+	}
+	return out
+}
+
+func RunRank(ctx context.Context, a *Account, checkpoint string, explain bool) error {
+	st := store.New(a.Store)
+	rr, err := st.Records()
+	if err != nil {
+		return err
+	}
+	m, err := TrainModel(rr, checkpoint)
+	if err != nil {
+		return err
+	}
+	ss, err := Candidates(ctx, a, st, a.Sub)
+	if err != nil {
+		return err
+	}
+	aspects, err := newPipeline(a, st).Aspects()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	pred := RankByModel(m, ss, aspects, now)
+	return writeRanking(os.Stdout, m, ss, aspects, pred, now, explain)
+}
+
+func writeRanking(out io.Writer, m *Model, ss []reddit.Submission, aspects map[string]float64, pred []float64, now time.Time, explain bool) error {
+	fmt.Fprintf(out, "model trained on %d posts, predicting likes per 1k followers at %s\n\n", m.Rows, m.Checkpoint)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RANK\tID\tSCORE\tPREDICTED\tTITLE")
+	for i, s := range ss {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%.2f\t%s\n", i+1, s.ID, s.Score, pred[i], s.Title)
+		if !explain {
+			continue
+		}
+		fmt.Fprintf(w, "\t\t\t%.2f\tintercept\n", m.Intercept)
+		for _, c := range m.Explain(Features(s, aspects[s.ID], now)) {
+			if c.Effect == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "\t\t\t%+.2f\t%s = %.3g\n", c.Effect, c.Feature, c.Value)
+		}
+	}
+	return w.Flush()
+}
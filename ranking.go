@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
+)
+
+// Ranker scores candidates, higher is better.
+type Ranker interface {
+	Name() string
+	Scores(ss []reddit.Submission, now time.Time) []float64
+}
+
+// RankingConfig is one weighted component of an account's ranking.
+type RankingConfig struct {
+	Strategy   string  `json:"strategy"`
+	Weight     float64 `json:"weight"`
+	Threshold  int     `json:"threshold,omitempty"`  // fresh only
+	Checkpoint string  `json:"checkpoint,omitempty"` // model only
+}
+
+var DefaultRanking = []RankingConfig{{Strategy: "score", Weight: 1}}
+
+var rankingStrategies = map[string]bool{
+	"score": true, "velocity": true, "comments": true, "random": true, "fresh": true, "model": true,
+}
+
+// ParseRanking reads the -rank flag, a comma separated list of strategy[:weight].
+func ParseRanking(s string) ([]RankingConfig, error) {
+	var rcs []RankingConfig
+	for _, part := range splitList(s) {
+		rc := RankingConfig{Strategy: part, Weight: 1}
+		if i := strings.Index(part, ":"); i >= 0 {
+			w, err := strconv.ParseFloat(part[i+1:], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ranking weight %q", part)
+			}
+			rc.Strategy, rc.Weight = part[:i], w
+		}
+		if !rankingStrategies[rc.Strategy] {
+			return nil, fmt.Errorf("unknown ranking strategy %q", rc.Strategy)
+		}
+		rcs = append(rcs, rc)
+	}
+	return rcs, nil
+}
+
+// defaultModelCheckpoint is the engagement the model learns
+// when the account does not configure one.
+const defaultModelCheckpoint = "24h"
+
+// ModelCheckpoint is the metric checkpoint the engagement model of the
+// account is trained on, for the model ranking and the rank command alike.
+func ModelCheckpoint(a *Account) string {
+	for _, rc := range a.Ranking {
+		if rc.Strategy == "model" && rc.Checkpoint != "" {
+			return rc.Checkpoint
+		}
+	}
+	return defaultModelCheckpoint
+}
+
+type WeightedRanker struct {
+	Ranker
+	Weight float64
+}
+
+func NewRankers(a *Account, st *store.Store) ([]WeightedRanker, error) {
+	rcs := a.Ranking
+	if len(rcs) == 0 {
+		rcs = DefaultRanking
+	}
+	var rs []WeightedRanker
+	for _, rc := range rcs {
+		var r Ranker
+		switch rc.Strategy {
+		case "score":
+			r = scoreRanker{}
+		case "velocity":
+			r = velocityRanker{}
+		case "comments":
+			r = commentsRanker{}
+		case "random":
+			r = randomRanker{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+		case "fresh":
+			r = freshRanker{Threshold: rc.Threshold}
+		case "model":
+			rr, err := st.Records()
+			if err != nil {
+				return nil, err
+			}
+			m, err := TrainModel(rr, ModelCheckpoint(a))
+			if err != nil {
+				log.Printf("skipping model ranking: %v", err)
+				continue
+			}
+			aspects, err := newPipeline(a, st).Aspects()
+			if err != nil {
+				return nil, err
+			}
+			r = modelRanker{m: m, aspects: aspects}
+		default:
+			return nil, fmt.Errorf("unknown ranking strategy %q", rc.Strategy)
+		}
+		rs = append(rs, WeightedRanker{r, rc.Weight})
+	}
+	return rs, nil
+}
+
+type Ranked struct {
+	Submission reddit.Submission
+	Total      float64
+	Parts      []float64 // weighted, normalized score of every ranker
+}
+
+// Rank orders ss by the weighted sum of every ranker's scores.
+// Scores are min-max normalized first so weights are comparable.
+func Rank(rs []WeightedRanker, ss []reddit.Submission, now time.Time) []Ranked {
+	ranked := make([]Ranked, len(ss))
+	for i, s := range ss {
+		ranked[i] = Ranked{Submission: s, Parts: make([]float64, len(rs))}
+	}
+	for j, r := range rs {
+		scores := normalize(r.Scores(ss, now))
+		for i := range ranked {
+			part := r.Weight * scores[i]
+			ranked[i].Parts[j] = part
+			ranked[i].Total += part
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Total > ranked[j].Total
+	})
+	return ranked
+}
+
+func normalize(xs []float64) []float64 {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, x := range xs {
+		lo, hi = math.Min(lo, x), math.Max(hi, x)
+	}
+	out := make([]float64, len(xs))
+	for i, x := range xs {
+		if hi > lo {
+			out[i] = (x - lo) / (hi - lo)
+		} else {
+			out[i] = 1
+		}
+	}
+	return out
+}
+
+func WriteRanking(out io.Writer, rs []WeightedRanker, ranked []Ranked) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprint(w, "RANK\tID\tSCORE\tTOTAL")
+	for _, r := range rs {
+		fmt.Fprintf(w, "\t%s*%g", strings.ToUpper(r.Name()), r.Weight)
+	}
+	fmt.Fprintln(w, "\tTITLE")
+	for i, rk := range ranked {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%.3f", i+1, rk.Submission.ID, rk.Submission.Score, rk.Total)
+		for _, p := range rk.Parts {
+			fmt.Fprintf(w, "\t%.3f", p)
+		}
+		fmt.Fprintf(w, "\t%s\n", rk.Submission.Title)
+	}
+	return w.Flush()
+}
+
+func ageHours(s reddit.Submission, now time.Time) float64 {
+	age := now.Sub(s.CreatedTime()).Hours()
+	return math.Max(age, 0.25)
+}
+
+type scoreRanker struct{}
+
+func (scoreRanker) Name() string { return "score" }
+
+func (scoreRanker) Scores(ss []reddit.Submission, now time.Time) []float64 {
+	out := make([]float64, len(ss))
+	for i, s := range ss {
+		out[i] = float64(s.Score)
+	}
+	return out
+}
+
+// velocityRanker favors posts that gather score quickly.
+type velocityRanker struct{}
+
+func (velocityRanker) Name() string { return "velocity" }
+
+func (velocityRanker) Scores(ss []reddit.Submission, now time.Time) []float64 {
+	out := make([]float64, len(ss))
+	for i, s := range ss {
+		out[i] = float64(s.Score) / ageHours(s, now)
+	}
+	return out
+}
+
+type commentsRanker struct{}
+
+func (commentsRanker) Name() string { return "comments" }
+
+func (commentsRanker) Scores(ss []reddit.Submission, now time.Time) []float64 {
+	out := make([]float64, len(ss))
+	for i, s := range ss {
+		out[i] = float64(s.NumComments) / math.Max(float64(s.Score), 1)
+	}
+	return out
+}
+
+// randomRanker samples candidates with probability proportional
+// to their score, so the feed does not always take the top post.
+type randomRanker struct {
+	rng *rand.Rand
+}
+
+func (randomRanker) Name() string { return "random" }
+
+func (r randomRanker) Scores(ss []reddit.Submission, now time.Time) []float64 {
+	out := make([]float64, len(ss))
+	for i, s := range ss {
+		// Efraimidis-Spirakis key, sorting by it is weighted sampling without replacement
+		out[i] = math.Pow(r.rng.Float64(), 1/math.Max(float64(s.Score), 1))
+	}
+	return out
+}
+
+// freshRanker prefers the newest posts at or above Threshold.
+type freshRanker struct {
+	Threshold int
+}
+
+func (freshRanker) Name() string { return "fresh" }
+
+func (r freshRanker) Scores(ss []reddit.Submission, now time.Time) []float64 {
+	out := make([]float64, len(ss))
+	for i, s := range ss {
+		if s.Score >= r.Threshold {
+			out[i] = 1 / ageHours(s, now)
+		}
+	}
+	return out
+}
+
+// modelRanker predicts the engagement of candidates. aspects holds the
+// aspect ratios of the images already prefetched, the others are
+// imputed by the model.
+type modelRanker struct {
+	m       *Model
+	aspects map[string]float64
+}
+
+func (modelRanker) Name() string { return "model" }
+
+func (r modelRanker) Scores(ss []reddit.Submission, now time.Time) []float64 {
+	out := make([]float64, len(ss))
+	for i, s := range ss {
+		out[i] = r.m.Predict(Features(s, r.aspects[s.ID], now))
+	}
+	return out
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
+)
+
+func TestModelCheckpoint(t *testing.T) {
+	tests := []struct {
+		ranking []RankingConfig
+		want    string
+	}{
+		{nil, "24h"},
+		{[]RankingConfig{{Strategy: "score", Weight: 1}}, "24h"},
+		{[]RankingConfig{{Strategy: "model", Weight: 1}}, "24h"},
+		{[]RankingConfig{{Strategy: "score", Weight: 1}, {Strategy: "model", Weight: 1, Checkpoint: "7d"}}, "7d"},
+	}
+	for _, tt := range tests {
+		a := DefaultAccount()
+		a.Ranking = tt.ranking
+		if got := ModelCheckpoint(a); got != tt.want {
+			t.Errorf("ModelCheckpoint(%+v) = %s, want %s", tt.ranking, got, tt.want)
+		}
+	}
+}
+
+// The model ranking trains on the configured checkpoint, here the
+// only one with enough history.
+func TestNewRankersModelCheckpoint(t *testing.T) {
+	st := store.New(t.TempDir())
+	for i := 0; i < modelMinRows; i++ {
+		err := st.Insert(&store.Record{
+			ID:       fmt.Sprintf("post%d", i),
+			Posted:   time.Now().Add(-8 * 24 * time.Hour),
+			Features: map[string]float64{"score": float64(100 * i)},
+			Metrics:  []*store.Metric{{Checkpoint: "7d", Likes: 10 * i, Followers: 1000}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		checkpoint string
+		rankers    int
+	}{{"", 0}, {"6h", 0}, {"7d", 1}} {
+		a := DefaultAccount()
+		a.Ranking = []RankingConfig{{Strategy: "model", Weight: 1, Checkpoint: tt.checkpoint}}
+		rs, err := NewRankers(a, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rs) != tt.rankers {
+			t.Errorf("checkpoint %q: %d rankers, want %d", tt.checkpoint, len(rs), tt.rankers)
+		}
+	}
+}
+
+// The model ranking sees the aspect ratio of images prefetched earlier,
+// here the only thing that tells the two candidates apart.
+func TestModelRankerAspects(t *testing.T) {
+	st := store.New(t.TempDir())
+	for i, r := range linearRecords(50) {
+		r.Posted = time.Now().Add(-time.Duration(i+2) * 24 * time.Hour)
+		if err := st.Insert(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx := map[string]interface{}{"entries": map[string]interface{}{
+		"wide": map[string]interface{}{"time": time.Now(), "width": 3000, "height": 1000},
+	}}
+	if err := st.PutState("prefetch", idx); err != nil {
+		t.Fatal(err)
+	}
+	a := DefaultAccount()
+	a.Ranking = []RankingConfig{{Strategy: "model", Weight: 1}}
+	rs, err := NewRankers(a, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := []reddit.Submission{{ID: "unknown", Score: 10}, {ID: "wide", Score: 10}}
+	ranked := Rank(rs, ss, time.Now())
+	if ranked[0].Submission.ID != "wide" {
+		t.Errorf("ranked %s first, want the wide image", ranked[0].Submission.ID)
+	}
+}
@@ -0,0 +1,280 @@
+// Package reddit reads submissions from the public Reddit JSON API.
+package reddit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type apiResponse struct {
+	Error   int
+	Message string
+	Kind    string
+	Data    struct {
+		Modhash  string
+		Children []struct {
+			Kind string
+			Data Submission
+		}
+	}
+}
+
+type Submission struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"` // fullname, t3_<id>
+	Title       string  `json:"title"`
+	Domain      string  `json:"domain"`
+	URL         string  `json:"url"`
+	Permalink   string  `json:"permalink"`
+	Thumbnail   string  `json:"thumbnail"`
+	Author      string  `json:"author"`
+	Subreddit   string  `json:"subreddit"`
+	SubredditID string  `json:"subreddit_id"`
+	Score       int     `json:"score"`
+	Ups         int     `json:"ups"`
+	Downs       int     `json:"downs"`
+	UpvoteRatio float64 `json:"upvote_ratio"`
+	NumComments int     `json:"num_comments"`
+	NumReports  *int    `json:"num_reports"`
+	Likes       *bool   `json:"likes"`
+
+	Created    float64 `json:"created"`
+	CreatedUTC float64 `json:"created_utc"`
+	Edited     Edited  `json:"edited"`
+
+	Selftext     string     `json:"selftext"`
+	SelftextHTML *string    `json:"selftext_html"`
+	IsSelf       bool       `json:"is_self"`
+	IsVideo      bool       `json:"is_video"`
+	PostHint     string     `json:"post_hint"` // image, link, hosted:video, rich:video, self
+	Preview      *Preview   `json:"preview"`
+	Media        *Media     `json:"media"`
+	MediaEmbed   MediaEmbed `json:"media_embed"`
+
+	Over18            bool   `json:"over_18"`
+	Spoiler           bool   `json:"spoiler"`
+	Stickied          bool   `json:"stickied"`
+	Clicked           bool   `json:"clicked"`
+	Hidden            bool   `json:"hidden"`
+	Saved             bool   `json:"saved"`
+	Distinguished     string `json:"distinguished"` // moderator, admin or empty
+	BannedBy          string `json:"banned_by"`
+	ApprovedBy        string `json:"approved_by"`
+	RemovedByCategory string `json:"removed_by_category"`
+
+	LinkFlairText       string `json:"link_flair_text"`
+	LinkFlairCSSClass   string `json:"link_flair_css_class"`
+	AuthorFlairText     string `json:"author_flair_text"`
+	AuthorFlairCSSClass string `json:"author_flair_css_class"`
+
+	CrosspostParent     string       `json:"crosspost_parent"`
+	CrosspostParentList []Submission `json:"crosspost_parent_list"`
+}
+
+func (s *Submission) CreatedTime() time.Time {
+	return time.Unix(int64(s.CreatedUTC), 0)
+}
+
+// EditedTime returns the last edit, the zero time if the post was never edited.
+func (s *Submission) EditedTime() time.Time {
+	return s.Edited.Time
+}
+
+// OriginalID returns the id of the crossposted submission, "" if s is not a crosspost.
+func (s *Submission) OriginalID() string {
+	if s.CrosspostParent != "" {
+		return strings.TrimPrefix(s.CrosspostParent, "t3_")
+	}
+	if len(s.CrosspostParentList) > 0 {
+		return s.CrosspostParentList[0].ID
+	}
+	return ""
+}
+
+// Removed returns why s was taken down by its author,
+// the moderators or Reddit, "" if it is still up.
+func (s *Submission) Removed() string {
+	switch {
+	case s.RemovedByCategory != "":
+		return "removed by " + s.RemovedByCategory
+	case s.Author == "[deleted]":
+		return "author deleted"
+	case s.Title == "[removed]" || s.Selftext == "[removed]":
+		return "removed"
+	case s.Title == "[deleted]" || s.Selftext == "[deleted]":
+		return "deleted"
+	}
+	return ""
+}
+
+// Edited is false in the API until a post is edited, then a timestamp.
+type Edited struct {
+	time.Time
+}
+
+func (e *Edited) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch t := v.(type) {
+	case float64:
+		e.Time = time.Unix(int64(t), 0)
+	case bool, nil:
+		e.Time = time.Time{}
+	default:
+		return fmt.Errorf("unexpected edited value %s", data)
+	}
+	return nil
+}
+
+func (e Edited) MarshalJSON() ([]byte, error) {
+	if e.IsZero() {
+		return []byte("false"), nil
+	}
+	return json.Marshal(float64(e.Unix()))
+}
+
+type Preview struct {
+	Images  []PreviewImage `json:"images"`
+	Enabled bool           `json:"enabled"`
+}
+
+type PreviewImage struct {
+	ID          string          `json:"id"`
+	Source      PreviewSource   `json:"source"`
+	Resolutions []PreviewSource `json:"resolutions"`
+}
+
+// PreviewSource is a resized copy hosted by Reddit.
+// URL is HTML escaped in the listing.
+type PreviewSource struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+type Media struct {
+	Type        string       `json:"type"`
+	RedditVideo *RedditVideo `json:"reddit_video"`
+	Oembed      *Oembed      `json:"oembed"`
+}
+
+type RedditVideo struct {
+	FallbackURL string `json:"fallback_url"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Duration    int    `json:"duration"`
+	IsGif       bool   `json:"is_gif"`
+}
+
+type Oembed struct {
+	Type         string `json:"type"`
+	Title        string `json:"title"`
+	ProviderName string `json:"provider_name"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+type MediaEmbed struct {
+	Content string `json:"content"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+}
+
+type ByScore []Submission
+
+func (s ByScore) Len() int {
+	return len(s)
+}
+func (s ByScore) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s ByScore) Less(i, j int) bool {
+	return s[i].Score > s[j].Score
+}
+
+// Client fetches listings. The zero value uses http.DefaultClient.
+type Client struct {
+	HTTP      *http.Client
+	UserAgent string
+}
+
+const DefaultUserAgent = "Ilia's Awesome Bot/1.0"
+
+func NewClient(hc *http.Client) *Client {
+	return &Client{HTTP: hc, UserAgent: DefaultUserAgent}
+}
+
+// Listing returns the front page of subreddit.
+func (c *Client) Listing(ctx context.Context, subreddit string) ([]Submission, error) {
+	return c.fetch(ctx, fmt.Sprintf("https://reddit.com/r/%s.json", subreddit))
+}
+
+// ByID returns the current state of the given submissions.
+// Submissions Reddit no longer knows about are missing from the result.
+func (c *Client) ByID(ctx context.Context, ids []string) ([]Submission, error) {
+	var ret []Submission
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > 100 {
+			n = 100
+		}
+		names := make([]string, n)
+		for i, id := range ids[:n] {
+			names[i] = "t3_" + id
+		}
+		ss, err := c.fetch(ctx, fmt.Sprintf("https://reddit.com/by_id/%s.json", strings.Join(names, ",")))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, ss...)
+		ids = ids[n:]
+	}
+	return ret, nil
+}
+
+func (c *Client) fetch(ctx context.Context, url string) ([]Submission, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	ua := c.UserAgent
+	if ua == "" {
+		ua = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", ua)
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var apiResp apiResponse
+	err = json.Unmarshal(body, &apiResp)
+	if err != nil {
+		return nil, err
+	}
+	if apiResp.Error != 0 {
+		return nil, errors.New(apiResp.Message)
+	}
+	ret := make([]Submission, len(apiResp.Data.Children))
+	for i, v := range apiResp.Data.Children {
+		ret[i] = v.Data
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/LamaLamer/redigram/reddit"
+)
+
+// Transport is used for every Reddit and image request.
+// It is swapped for a recording or replaying transport by -record and -replay.
+var Transport http.RoundTripper = http.DefaultTransport
+
+// httpClient has no timeout of its own, requests are bounded
+// by the deadlines of their context.
+func httpClient() *http.Client {
+	return &http.Client{
+		Transport: Transport,
+	}
+}
+
+func redditClient() *reddit.Client {
+	return reddit.NewClient(httpClient())
+}
+
+type recording struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+func recordingName(req *http.Request) string {
+	sum := sha1.Sum([]byte(req.Method + " " + req.URL.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// redactedHeaders are left out of recordings, they carry the
+// session of whoever recorded them.
+var redactedHeaders = []string{"Set-Cookie", "Cookie", "Authorization", "X-Reddit-Loid", "X-Reddit-Session"}
+
+// redactedParams matches query parameters whose values are replaced in
+// the recorded URL. The file name still comes from the real URL.
+var redactedParams = regexp.MustCompile(`(?i)token|key|secret|session|sig|auth`)
+
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	changed := false
+	for k := range q {
+		if redactedParams.MatchString(k) {
+			q.Set(k, "REDACTED")
+			changed = true
+		}
+	}
+	if !changed {
+		return u.String()
+	}
+	r := *u
+	r.RawQuery = q.Encode()
+	return r.String()
+}
+
+// RecordingTransport saves every response it sees into Dir,
+// without cookies, credentials or tokens.
+type RecordingTransport struct {
+	Dir  string
+	Next http.RoundTripper
+}
+
+func (rt *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.Next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	name := recordingName(req)
+	header := resp.Header.Clone()
+	for _, h := range redactedHeaders {
+		header.Del(h)
+	}
+	meta, err := json.MarshalIndent(recording{
+		Method: req.Method,
+		URL:    redactURL(req.URL),
+		Status: resp.StatusCode,
+		Header: header,
+		Body:   name + ".body",
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(rt.Dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(rt.Dir, name+".body"), body, 0644); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(rt.Dir, name+".json"), meta, 0644); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ReplayTransport answers requests from a directory written by RecordingTransport.
+type ReplayTransport struct {
+	Dir string
+}
+
+func (rt *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	name := recordingName(req)
+	meta, err := ioutil.ReadFile(filepath.Join(rt.Dir, name+".json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("replay: no recording for %s %s", req.Method, req.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec recording
+	if err := json.Unmarshal(meta, &rec); err != nil {
+		return nil, fmt.Errorf("replay: %s: %v", name, err)
+	}
+	body, err := ioutil.ReadFile(filepath.Join(rt.Dir, rec.Body))
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rec.Status, http.StatusText(rec.Status)),
+		StatusCode:    rec.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rec.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
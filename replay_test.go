@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "record testdata/replay again from the Reddit stub")
+
+const replayDir = "testdata/replay"
+
+// TestReplayDoPost posts from the recorded session in testdata/replay,
+// which holds the r/memes listing and its three images.
+func TestReplayDoPost(t *testing.T) {
+	if *update {
+		e := newTestEnv(t)
+		if err := os.RemoveAll(replayDir); err != nil {
+			t.Fatal(err)
+		}
+		Transport = &RecordingTransport{Dir: replayDir, Next: e.reddit}
+		if err := DoPost(context.Background(), e.a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := newTestEnv(t)
+	Transport = &ReplayTransport{Dir: replayDir}
+	if err := DoPost(context.Background(), e.a); err != nil {
+		t.Fatal(err)
+	}
+	r, err := e.st.Get("post1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := e.insta.Media()
+	if len(mm) != 1 || len(r.Results) != 1 || r.Results[0].ID != mm[0].ID || r.Title != "Post number 1" {
+		t.Errorf("record %+v, results %+v, media %+v", r, r.Results, mm)
+	}
+	// a request that was never recorded fails instead of going out
+	if _, err := redditClient().Listing(context.Background(), "cats"); err == nil {
+		t.Error("unrecorded listing was served")
+	}
+}
+
+func TestReplayRedacted(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join(replayDir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no recordings")
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rec recording
+		if err := json.Unmarshal(data, &rec); err != nil {
+			t.Fatalf("%s: %v", f, err)
+		}
+		for _, h := range redactedHeaders {
+			if rec.Header.Get(h) != "" {
+				t.Errorf("%s: %s was recorded", f, h)
+			}
+		}
+		if strings.Contains(string(data), "s3cr3t") {
+			t.Errorf("%s: holds the session cookie", f)
+		}
+	}
+}
+
+func TestRecordingTransportRedacts(t *testing.T) {
+	dir := t.TempDir()
+	rs := newRedditStub("memes", 1)
+	rs.images["https://i.redd.it/post1.jpg?access_token=t0k3n&width=640"] = rs.images["https://i.redd.it/post1.jpg"]
+	rt := &RecordingTransport{Dir: dir, Next: rs}
+	c := httpClient()
+	c.Transport = rt
+	resp, err := c.Get("https://i.redd.it/post1.jpg?access_token=t0k3n&width=640")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// the response itself is untouched
+	if resp.Header.Get("Set-Cookie") == "" {
+		t.Error("Set-Cookie removed from the live response")
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("%d recordings", len(files))
+	}
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec recording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.URL != "https://i.redd.it/post1.jpg?access_token=REDACTED&width=640" {
+		t.Errorf("recorded URL %s", rec.URL)
+	}
+	if rec.Header.Get("Set-Cookie") != "" || rec.Header.Get("X-Reddit-Loid") != "" || rec.Header.Get("Content-Type") != "image/jpeg" {
+		t.Errorf("recorded header %v", rec.Header)
+	}
+
+	// replaying finds it by the real URL
+	c.Transport = &ReplayTransport{Dir: dir}
+	resp, err = c.Get("https://i.redd.it/post1.jpg?access_token=t0k3n&width=640")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("replayed status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/LamaLamer/redigram/photo"
+	"github.com/LamaLamer/redigram/publish"
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
+)
+
+// RunReview pages through the ranked listing in the terminal and lets
+// the user post, skip or blocklist every candidate, or edit its caption.
+// Skipped posts are rejected in the approval queue so they do not come back.
+func RunReview(ctx context.Context, a *Account, width int, ascii bool) error {
+	st := store.New(a.Store)
+	pick, err := ChooseSource(a, st)
+	if err != nil {
+		return err
+	}
+	vv, err := EvaluateListing(ctx, a, st, pick.Source)
+	if err != nil {
+		return err
+	}
+	verdicts := map[string]Verdict{}
+	var ss []reddit.Submission
+	for _, v := range vv {
+		if v.Rule == "used" || v.Rule == "queued" || !photo.IsImageURL(v.Submission.URL) {
+			continue
+		}
+		verdicts[v.Submission.ID] = v
+		ss = append(ss, v.Submission)
+	}
+	rs, err := NewRankers(a, st)
+	if err != nil {
+		return err
+	}
+	ranked := Rank(rs, ss, time.Now())
+	if len(ranked) == 0 {
+		fmt.Println("nothing to review")
+		return nil
+	}
+
+	restore, err := rawTerminal()
+	if err != nil {
+		return err
+	}
+	// restore is nil when switching back to raw mode failed
+	defer func() {
+		if restore != nil {
+			restore()
+		}
+	}()
+	keys := bufio.NewReader(os.Stdin)
+	blocked := map[string]bool{}
+	status := ""
+	for i, rk := range ranked {
+		s := rk.Submission
+		if blocked[strings.ToLower(s.Author)] {
+			continue
+		}
+		v := verdicts[s.ID]
+		p, err := newPipeline(a, st).MakePost(ctx, []reddit.Submission{s})
+		if err != nil {
+			status = fmt.Sprintf("%s: %v", s.ID, err)
+			continue
+		}
+	prompt:
+		for {
+			writeReviewCard(os.Stdout, i+1, len(ranked), rk, v, p, status, width, ascii)
+			status = ""
+			key, err := keys.ReadByte()
+			if err != nil {
+				return err
+			}
+			switch key {
+			case 'p':
+				if !v.Passed() {
+					status = "rejected by " + v.Rule + ", not posting"
+					continue
+				}
+				if !a.Dry {
+					if err := checkQuota(a, st, s.Subreddit); err != nil {
+						status = err.Error()
+						continue
+					}
+				}
+				restore()
+				perr := PublishPost(ctx, a, st, p)
+				if restore, err = rawTerminal(); err != nil {
+					return err
+				}
+				status = "posted " + s.ID
+				if perr != nil {
+					status = perr.Error()
+				} else if !a.Dry {
+					if err := pick.Record(st); err != nil {
+						return err
+					}
+				}
+				break prompt
+			case 's':
+				if err := rejectInQueue(st, p); err != nil {
+					return err
+				}
+				break prompt
+			case 'b':
+				err := BlockAuthor(st, &BlockedAuthor{
+					Name:   s.Author,
+					Time:   time.Now(),
+					Reason: "blocklisted in review",
+					Post:   s.ID,
+				})
+				if err != nil {
+					return err
+				}
+				blocked[strings.ToLower(s.Author)] = true
+				break prompt
+			case 'e':
+				restore()
+				caption, eerr := editCaption(p.Caption)
+				if restore, err = rawTerminal(); err != nil {
+					return err
+				}
+				if eerr != nil {
+					status = eerr.Error()
+					continue
+				}
+				p.Caption = caption
+			case 'q', 3, 4: // ctrl-c and ctrl-d arrive as bytes in raw mode
+				return nil
+			}
+		}
+	}
+	fmt.Print("no more candidates\r\n")
+	return nil
+}
+
+const reviewSkipReason = "skipped in review"
+
+func rejectInQueue(st *store.Store, p *publish.Post) error {
+	return UpdateQueue(st, func(q *Queue) error {
+		if q.Get(p.Submission.ID) != nil {
+			return q.Decide(st, p.Submission.ID, QueueRejected, reviewSkipReason)
+		}
+		now := time.Now()
+		q.Entries = append(q.Entries, &QueueEntry{
+			ID:         p.Submission.ID,
+			Status:     QueueRejected,
+			Prepared:   now,
+			Decided:    now,
+			Caption:    p.Caption,
+			Submission: p.Submission,
+			Reason:     reviewSkipReason,
+		})
+		return nil
+	})
+}
+
+func writeReviewCard(out io.Writer, n, total int, rk Ranked, v Verdict, p *publish.Post, status string, width int, ascii bool) {
+	s := rk.Submission
+	b := p.Image.Bounds()
+	fmt.Fprint(out, "\x1b[2J\x1b[H")
+	fmt.Fprintf(out, "[%d/%d] r/%s  score %d  rank %.3f  u/%s\r\n", n, total, s.Subreddit, s.Score, rk.Total, s.Author)
+	fmt.Fprintf(out, "%s\r\n", s.Title)
+	if v.Passed() {
+		fmt.Fprint(out, "filters: ok\r\n")
+	} else {
+		fmt.Fprintf(out, "filters: rejected by %s, %s\r\n", v.Rule, v.Reason)
+	}
+	fmt.Fprintf(out, "image: %dx%d\r\n", b.Dx(), b.Dy())
+	fmt.Fprintf(out, "caption: %s\r\n\r\n", strings.Replace(p.Caption, "\n", "\r\n", -1))
+	if ascii {
+		writeASCII(out, p.Image, width)
+	} else {
+		writeANSI(out, p.Image, width)
+	}
+	fmt.Fprint(out, "\r\n[p]ost  [s]kip  [b]locklist author  [e]dit caption  [q]uit\r\n")
+	if status != "" {
+		fmt.Fprintf(out, "%s\r\n", status)
+	}
+}
+
+// writeANSI draws two pixel rows per line with the upper half block,
+// foreground for the top pixel and background for the bottom one.
+func writeANSI(out io.Writer, im image.Image, width int) {
+	b := im.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return
+	}
+	height := b.Dy() * width / b.Dx()
+	rgb := func(x, y int) (uint32, uint32, uint32) {
+		r, g, bl, _ := im.At(b.Min.X+x*b.Dx()/width, b.Min.Y+y*b.Dy()/height).RGBA()
+		return r >> 8, g >> 8, bl >> 8
+	}
+	for y := 0; y+1 < height; y += 2 {
+		for x := 0; x < width; x++ {
+			r1, g1, b1 := rgb(x, y)
+			r2, g2, b2 := rgb(x, y+1)
+			fmt.Fprintf(out, "\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm▀", r1, g1, b1, r2, g2, b2)
+		}
+		fmt.Fprint(out, "\x1b[0m\r\n")
+	}
+}
+
+const asciiRamp = " .:-=+*#%@"
+
+// writeASCII draws the image in characters of increasing density,
+// halving the rows since terminal cells are about twice as tall as wide.
+func writeASCII(out io.Writer, im image.Image, width int) {
+	b := im.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return
+	}
+	height := b.Dy() * width / b.Dx() / 2
+	for y := 0; y < height; y++ {
+		line := make([]byte, width)
+		for x := 0; x < width; x++ {
+			r, g, bl, _ := im.At(b.Min.X+x*b.Dx()/width, b.Min.Y+y*b.Dy()/height).RGBA()
+			lum := (299*r + 587*g + 114*bl) / 1000
+			line[x] = asciiRamp[int(lum)*(len(asciiRamp)-1)/0xffff]
+		}
+		fmt.Fprintf(out, "%s\r\n", line)
+	}
+}
+
+// rawTerminal switches the terminal to single keystroke input
+// and returns a function restoring the previous mode.
+func rawTerminal() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("review needs a terminal: %v", err)
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, err
+	}
+	return func() {
+		stty(strings.TrimSpace(saved))
+	}, nil
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// editCaption opens the caption in $EDITOR and returns the saved text.
+func editCaption(caption string) (string, error) {
+	f, err := ioutil.TempFile("", "redigram-caption-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(caption); err != nil {
+		f.Close()
+		return "", err
+	}
+	f.Close()
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command("sh", "-c", editor+` "$0"`, f.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("editor: %v", err)
+	}
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/LamaLamer/redigram/caption"
+	"github.com/LamaLamer/redigram/store"
+	"github.com/montanaflynn/stats"
+)
+
+type statsDimension struct {
+	Name string
+	Keys func(r *store.Record) []string
+}
+
+var statsDimensions = []statsDimension{
+	{"subreddit", func(r *store.Record) []string {
+		return []string{r.Subreddit}
+	}},
+	{"hour", func(r *store.Record) []string {
+		return []string{fmt.Sprintf("%02d:00", r.Posted.Hour())}
+	}},
+	{"caption style", func(r *store.Record) []string {
+		return []string{caption.Style(r.Caption, r.Title)}
+	}},
+	{"hashtag", func(r *store.Record) []string {
+		return caption.Hashtags(r.Caption)
+	}},
+}
+
+type statsGroup struct {
+	Key      string
+	Likes    stats.Float64Data
+	Comments stats.Float64Data
+}
+
+func RunStats(a *Account, checkpoint string) error {
+	rr, err := store.New(a.Store).Records()
+	if err != nil {
+		return err
+	}
+	return WriteStats(os.Stdout, rr, checkpoint)
+}
+
+// WriteStats reports engagement at the given checkpoint
+// broken down by every stats dimension.
+func WriteStats(out io.Writer, rr []*store.Record, checkpoint string) error {
+	n := 0
+	for _, r := range rr {
+		if r.MetricAt(checkpoint) != nil {
+			n++
+		}
+	}
+	fmt.Fprintf(out, "%d posts with metrics at %s\n", n, checkpoint)
+	if n == 0 {
+		return nil
+	}
+	for _, dim := range statsDimensions {
+		groups := map[string]*statsGroup{}
+		for _, r := range rr {
+			m := r.MetricAt(checkpoint)
+			if m == nil {
+				continue
+			}
+			for _, key := range dim.Keys(r) {
+				g, ok := groups[key]
+				if !ok {
+					g = &statsGroup{Key: key}
+					groups[key] = g
+				}
+				g.Likes = append(g.Likes, float64(m.Likes))
+				g.Comments = append(g.Comments, float64(m.Comments))
+			}
+		}
+		if err := writeStatsTable(out, dim.Name, groups); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeStatsTable(out io.Writer, name string, groups map[string]*statsGroup) error {
+	type row struct {
+		key                  string
+		n                    int
+		median, p75, p90, cm float64
+	}
+	var rows []row
+	for _, g := range groups {
+		median, err := stats.Median(g.Likes)
+		if err != nil {
+			return err
+		}
+		p75, err := stats.PercentileNearestRank(g.Likes, 75)
+		if err != nil {
+			return err
+		}
+		p90, err := stats.PercentileNearestRank(g.Likes, 90)
+		if err != nil {
+			return err
+		}
+		cm, err := stats.Median(g.Comments)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, row{g.Key, len(g.Likes), median, p75, p90, cm})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].median != rows[j].median {
+			return rows[i].median > rows[j].median
+		}
+		return rows[i].key < rows[j].key
+	})
+	fmt.Fprintf(out, "\nby %s\n", name)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "\tPOSTS\tMEDIAN LIKES\tP75 LIKES\tP90 LIKES\tMEDIAN COMMENTS\t")
+	for _, r := range rows {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t\n", r.key, r.n,
+			fmtFloat(r.median), fmtFloat(r.p75), fmtFloat(r.p90), fmtFloat(r.cm))
+	}
+	return w.Flush()
+}
+
+func fmtFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 1, 64)
+}
@@ -1,26 +1,66 @@
 package main
 
 import (
-	"github.com/peterbourgon/diskv"
-)
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
 
-type Store struct {
-	kv *diskv.Diskv
-}
+	"github.com/LamaLamer/redigram/store"
+)
 
-func NewStore(dir string) *Store {
-	return &Store{
-		kv: diskv.New(diskv.Options{
-			BasePath:     dir,
-			CacheSizeMax: 1024 * 1024,
-		}),
+// RunStore lists, shows or removes the records of the store.
+// Removing a record makes its submission eligible again.
+func RunStore(a *Account, args []string) error {
+	st := store.New(a.Store)
+	if len(args) == 0 {
+		return fmt.Errorf("usage: store list|show <id>|rm <id>")
 	}
+	switch args[0] {
+	case "list":
+		rr, err := st.Records()
+		if err != nil {
+			return err
+		}
+		return WriteRecords(os.Stdout, rr)
+	case "show", "rm":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: store %s <id>", args[0])
+		}
+		r, err := FindRecord(st, args[1])
+		if err != nil {
+			return err
+		}
+		if args[0] == "rm" {
+			return st.Remove(r.ID)
+		}
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	return fmt.Errorf("unknown store command %q", args[0])
 }
 
-func (s *Store) Contains(sub Submission) bool {
-	return s.kv.Has(sub.Id)
-}
-
-func (s *Store) Insert(sub Submission) error {
-	return s.kv.WriteString(sub.Id, sub.Title)
+func WriteRecords(out io.Writer, rr []*store.Record) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "POSTED\tID\tSUB\tSTATUS\tTITLE")
+	for _, r := range rr {
+		posted := ""
+		if !r.Posted.IsZero() {
+			posted = r.Posted.Format("2006-01-02 15:04")
+		}
+		status := r.Status
+		switch {
+		case r.Dry:
+			status = "dry"
+		case status == "":
+			status = "posted"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", posted, r.ID, r.Subreddit, status, r.Title)
+	}
+	return w.Flush()
 }
@@ -0,0 +1,51 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	lockName = statePrefix + "lock"
+	// lockWait is how long Lock waits for another process.
+	lockWait = 30 * time.Second
+	// lockStale is the age at which a lock is taken to be left
+	// behind by a crashed process. Nobody holds it for long.
+	lockStale = time.Minute
+)
+
+// Lock takes the lock every process using the store shares, for reading,
+// changing and writing back state like the approval queue. It is not
+// held across downloads or uploads: callers reload what they change
+// under the lock.
+func (s *Store) Lock() (unlock func(), err error) {
+	path := filepath.Join(s.kv.BasePath, lockName)
+	if err := os.MkdirAll(s.kv.BasePath, 0755); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(lockWait)
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > lockStale {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			pid, _ := ioutil.ReadFile(path)
+			return nil, fmt.Errorf("store %s is locked by process %s", s.kv.BasePath, strings.TrimSpace(string(pid)))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
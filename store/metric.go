@@ -0,0 +1,77 @@
+package store
+
+import "time"
+
+// Metric is an engagement sample of a published post.
+type Metric struct {
+	Checkpoint string    `json:"checkpoint"`
+	Time       time.Time `json:"time"`
+	Likes      int       `json:"likes"`
+	Comments   int       `json:"comments"`
+	Followers  int       `json:"followers"`
+}
+
+// MetricCheckpoints are the post ages at which engagement is sampled.
+var MetricCheckpoints = []struct {
+	Label string
+	Age   time.Duration
+}{
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+}
+
+// IsCheckpoint reports whether label names a checkpoint or is "latest".
+func IsCheckpoint(label string) bool {
+	for _, cp := range MetricCheckpoints {
+		if cp.Label == label {
+			return true
+		}
+	}
+	return label == "latest"
+}
+
+// InstagramID returns the media id the post got on instagram, if any.
+func (r *Record) InstagramID() string {
+	for _, res := range r.Results {
+		if res.Publisher == "instagram" && res.Error == "" && res.ID != "" {
+			return res.ID
+		}
+	}
+	return ""
+}
+
+// MetricAt returns the sample taken at checkpoint, or the
+// most recent one when checkpoint is "latest".
+func (r *Record) MetricAt(checkpoint string) *Metric {
+	if checkpoint == "latest" {
+		if len(r.Metrics) == 0 {
+			return nil
+		}
+		return r.Metrics[len(r.Metrics)-1]
+	}
+	for _, m := range r.Metrics {
+		if m.Checkpoint == checkpoint {
+			return m
+		}
+	}
+	return nil
+}
+
+// DueCheckpoint returns the checkpoint that should be sampled now.
+// When the collector fell behind only the latest one is taken,
+// so a late sample is never recorded as an early checkpoint.
+func (r *Record) DueCheckpoint(now time.Time) string {
+	age := now.Sub(r.Posted)
+	for i := len(MetricCheckpoints) - 1; i >= 0; i-- {
+		cp := MetricCheckpoints[i]
+		if r.MetricAt(cp.Label) != nil {
+			return ""
+		}
+		if age >= cp.Age {
+			return cp.Label
+		}
+	}
+	return ""
+}
@@ -0,0 +1,199 @@
+// Package store keeps the submissions an account used, what became of
+// them, and any other state of the bot, in a diskv directory.
+package store
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/LamaLamer/redigram/publish"
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/peterbourgon/diskv"
+)
+
+type Store struct {
+	kv *diskv.Diskv
+}
+
+// Record is what the store keeps for every submission we used.
+// Older stores only contain the title, those records have a zero Posted time.
+// Older versions also recorded dry runs, marked Dry: those are no posts,
+// dry runs no longer write records.
+type Record struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Caption   string    `json:"caption,omitempty"`
+	Subreddit string    `json:"subreddit"`
+	Author    string    `json:"author,omitempty"`
+	Original  string    `json:"original,omitempty"` // id of the crossposted submission
+	Posted    time.Time `json:"posted"`
+	Dry       bool      `json:"dry,omitempty"` // set by older versions only
+	Status    string    `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+
+	Results []*publish.Result `json:"results,omitempty"`
+	Metrics []*Metric         `json:"metrics,omitempty"`
+
+	// Features are the model inputs at the time of posting.
+	Features map[string]float64 `json:"features,omitempty"`
+	// ImageHash is the photo.Hash of the posted image, to spot reposts.
+	ImageHash uint64 `json:"image_hash,omitempty"`
+
+	Takedown *Takedown `json:"takedown,omitempty"`
+}
+
+// Takedown records why and when a published post was removed again.
+type Takedown struct {
+	Time        time.Time `json:"time"`
+	Reason      string    `json:"reason"`
+	RequestedBy string    `json:"requested_by,omitempty"`
+}
+
+const (
+	StatusFailed      = "failed"
+	StatusTakenDown   = "taken down"
+	StatusInterrupted = "interrupted"
+)
+
+func NewRecord(sub reddit.Submission) *Record {
+	return &Record{
+		ID:        sub.ID,
+		Title:     sub.Title,
+		Subreddit: sub.Subreddit,
+		Author:    sub.Author,
+		Original:  sub.OriginalID(),
+		Posted:    time.Now(),
+	}
+}
+
+// New opens the store in dir. Nothing is cached in memory, other
+// processes may write to the same store at any time.
+func New(dir string) *Store {
+	return &Store{
+		kv: diskv.New(diskv.Options{
+			BasePath: dir,
+		}),
+	}
+}
+
+func aliasKey(id string) string {
+	return statePrefix + "alias-" + id
+}
+
+// Contains reports whether sub was used, either itself or as the
+// original of a crosspost, and likewise for the original of sub.
+func (s *Store) Contains(sub reddit.Submission) bool {
+	ids := []string{sub.ID}
+	if orig := sub.OriginalID(); orig != "" {
+		ids = append(ids, orig)
+	}
+	for _, id := range ids {
+		if s.kv.Has(id) || s.kv.Has(aliasKey(id)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Insert writes the record, and an alias for the original
+// post when the record is a crosspost.
+func (s *Store) Insert(r *Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if r.Original != "" {
+		if err := s.kv.Write(aliasKey(r.Original), []byte(r.ID)); err != nil {
+			return err
+		}
+	}
+	return s.kv.Write(r.ID, data)
+}
+
+func (s *Store) Remove(id string) error {
+	if r, err := s.Get(id); err == nil && r.Original != "" {
+		s.kv.Erase(aliasKey(r.Original))
+	}
+	return s.kv.Erase(id)
+}
+
+// Has reports whether there is a record for id.
+func (s *Store) Has(id string) bool {
+	return !strings.HasPrefix(id, statePrefix) && s.kv.Has(id)
+}
+
+func (s *Store) Get(id string) (*Record, error) {
+	data, err := s.kv.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	var r Record
+	if err := json.Unmarshal(data, &r); err != nil || r.ID == "" {
+		return &Record{ID: id, Title: string(data)}, nil
+	}
+	return &r, nil
+}
+
+// Records returns every record in the store, most recently posted first.
+func (s *Store) Records() ([]*Record, error) {
+	var rr []*Record
+	for key := range s.kv.Keys(nil) {
+		if strings.HasPrefix(key, statePrefix) {
+			continue
+		}
+		r, err := s.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		rr = append(rr, r)
+	}
+	sort.Slice(rr, func(i, j int) bool {
+		return rr[i].Posted.After(rr[j].Posted)
+	})
+	return rr, nil
+}
+
+// Anything that is not a submission record is kept under statePrefix,
+// which can never clash with a reddit id.
+const statePrefix = "state-"
+
+// GetState decodes the named state into v, leaving v untouched
+// if it was never written.
+func (s *Store) GetState(name string, v interface{}) error {
+	key := statePrefix + name
+	if !s.kv.Has(key) {
+		return nil
+	}
+	data, err := s.kv.Read(key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *Store) PutState(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.kv.Write(statePrefix+name, data)
+}
+
+// PutStateData keeps raw bytes, like the image of a queued post, as state.
+func (s *Store) PutStateData(name string, data []byte) error {
+	return s.kv.Write(statePrefix+name, data)
+}
+
+func (s *Store) GetStateData(name string) ([]byte, error) {
+	return s.kv.Read(statePrefix + name)
+}
+
+func (s *Store) HasState(name string) bool {
+	return s.kv.Has(statePrefix + name)
+}
+
+func (s *Store) RemoveState(name string) error {
+	return s.kv.Erase(statePrefix + name)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/LamaLamer/redigram/publish"
+	"github.com/LamaLamer/redigram/store"
+)
+
+// Blocklist holds the Reddit authors an account never posts from again.
+type Blocklist struct {
+	Authors map[string]*BlockedAuthor `json:"authors"` // keyed by lowercase name
+}
+
+type BlockedAuthor struct {
+	Name        string    `json:"name"`
+	Time        time.Time `json:"time"`
+	Reason      string    `json:"reason"`
+	RequestedBy string    `json:"requested_by,omitempty"`
+	Post        string    `json:"post,omitempty"`
+}
+
+const blocklistKey = "blocklist"
+
+func (b *Blocklist) Contains(author string) bool {
+	_, ok := b.Authors[strings.ToLower(author)]
+	return ok
+}
+
+// Add blocklists an author, keeping the first entry if already there.
+func (b *Blocklist) Add(ba *BlockedAuthor) {
+	if b.Authors == nil {
+		b.Authors = map[string]*BlockedAuthor{}
+	}
+	if !b.Contains(ba.Name) {
+		b.Authors[strings.ToLower(ba.Name)] = ba
+	}
+}
+
+// BlockAuthor adds an author to the blocklist of the store,
+// under the store lock so entries other processes add are kept.
+func BlockAuthor(st *store.Store, ba *BlockedAuthor) error {
+	unlock, err := st.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	var bl Blocklist
+	if err := st.GetState(blocklistKey, &bl); err != nil {
+		return err
+	}
+	bl.Add(ba)
+	return st.PutState(blocklistKey, &bl)
+}
+
+var (
+	rePermalink = regexp.MustCompile(`(?:/comments/|redd\.it/)([a-z0-9]+)`)
+	reInstaURL  = regexp.MustCompile(`instagram\.com/(?:p|reel)/([^/?#]+)`)
+)
+
+// FindRecord looks a published post up by Reddit id, Reddit
+// permalink, Instagram shortcode or Instagram URL.
+func FindRecord(st *store.Store, ref string) (*store.Record, error) {
+	ref = strings.TrimSpace(ref)
+	if m := rePermalink.FindStringSubmatch(ref); m != nil {
+		ref = m[1]
+	} else if m := reInstaURL.FindStringSubmatch(ref); m != nil {
+		ref = m[1]
+	}
+	ref = strings.TrimPrefix(ref, "t3_")
+	if st.Has(ref) {
+		return st.Get(ref)
+	}
+	rr, err := st.Records()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rr {
+		for _, res := range r.Results {
+			if res.Code == ref || (res.ID != "" && res.ID == ref) {
+				return r, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no post %q in the store", ref)
+}
+
+func RunTakedown(ctx context.Context, a *Account, ref, by, reason string) error {
+	st := store.New(a.Store)
+	r, err := FindRecord(st, ref)
+	if err != nil {
+		return err
+	}
+	if r.Takedown == nil {
+		if id := r.InstagramID(); id != "" {
+			insta, err := a.Instagram().Login(ctx)
+			if err != nil {
+				return err
+			}
+			defer insta.Logout()
+			if err := publish.DeleteMedia(insta, id); err != nil {
+				return err
+			}
+		}
+		r.Takedown = &store.Takedown{Time: time.Now(), Reason: reason, RequestedBy: by}
+		r.Status = store.StatusTakenDown
+		if err := st.Insert(r); err != nil {
+			return err
+		}
+		fmt.Printf("took down %s (%s)\n", r.ID, r.Title)
+	} else {
+		fmt.Printf("%s was already taken down on %s\n", r.ID, r.Takedown.Time.Format(time.RFC3339))
+	}
+	author := r.Author
+	if author == "" {
+		// records from before authors were stored
+		ss, err := fetchByID(ctx, []string{r.ID})
+		if err != nil {
+			return err
+		}
+		if len(ss) > 0 {
+			author = ss[0].Author
+		}
+	}
+	if author == "" || author == "[deleted]" {
+		return fmt.Errorf("author of %s is unknown, not blocklisted", r.ID)
+	}
+	err = BlockAuthor(st, &BlockedAuthor{
+		Name:        author,
+		Time:        time.Now(),
+		Reason:      reason,
+		RequestedBy: by,
+		Post:        r.ID,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("blocklisted u/%s\n", author)
+	return nil
+}
+
+// Watch re-checks the Reddit submissions the account published within
+// its takedown window and deletes the instagram post of every one that
+// was removed or deleted since.
+func Watch(ctx context.Context, a *Account) error {
+	if a.TakedownWindow.Duration <= 0 {
+		return nil
+	}
+	st := store.New(a.Store)
+	rr, err := st.Records()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	watched := map[string]*store.Record{}
+	var ids []string
+	for _, r := range rr {
+		if now.Sub(r.Posted) > a.TakedownWindow.Duration {
+			break // newest first
+		}
+		if r.Dry || r.Takedown != nil || r.InstagramID() == "" {
+			continue
+		}
+		watched[r.ID] = r
+		ids = append(ids, r.ID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	ss, err := fetchByID(ctx, ids)
+	if err != nil {
+		return err
+	}
+	var removed []*store.Record
+	for _, s := range ss {
+		if reason := s.Removed(); reason != "" {
+			r := watched[s.ID]
+			r.Takedown = &store.Takedown{Reason: "reddit: " + reason}
+			removed = append(removed, r)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	insta, err := a.Instagram().Login(ctx)
+	if err != nil {
+		return err
+	}
+	defer insta.Logout()
+	for _, r := range removed {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := publish.DeleteMedia(insta, r.InstagramID()); err != nil {
+			log.Printf("%s: takedown of %s: %v", a, r.ID, err)
+			continue
+		}
+		r.Takedown.Time = time.Now()
+		r.Status = store.StatusTakenDown
+		if err := st.Insert(r); err != nil {
+			return err
+		}
+		log.Printf("%s: took down %s (%s), %s", a, r.ID, r.Title, r.Takedown.Reason)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LamaLamer/redigram/publish"
+	"github.com/LamaLamer/redigram/store"
+)
+
+func TestFindRecord(t *testing.T) {
+	st := store.New(t.TempDir())
+	err := st.Insert(&store.Record{
+		ID:      "abc123",
+		Posted:  time.Now(),
+		Results: []*publish.Result{{Publisher: "instagram", ID: "17_1", Code: "BxYz-9"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{
+		"abc123",
+		"t3_abc123",
+		"https://www.reddit.com/r/memes/comments/abc123/a_title/",
+		"/r/memes/comments/abc123/",
+		"https://redd.it/abc123",
+		"BxYz-9",
+		"https://www.instagram.com/p/BxYz-9/?igshid=xyz",
+		"https://instagram.com/reel/BxYz-9",
+		"17_1",
+	} {
+		r, err := FindRecord(st, ref)
+		if err != nil || r.ID != "abc123" {
+			t.Errorf("%s: %+v, %v", ref, r, err)
+		}
+	}
+	for _, ref := range []string{"nope", "https://redd.it/nope", "https://www.instagram.com/p/nope/"} {
+		if r, err := FindRecord(st, ref); err == nil {
+			t.Errorf("%s found %+v", ref, r)
+		}
+	}
+}
+
+// A takedown deletes the post on instagram and blocklists its author.
+func TestRunTakedown(t *testing.T) {
+	e := newTestEnv(t)
+	if err := DoPost(context.Background(), e.a); err != nil {
+		t.Fatal(err)
+	}
+	mm := e.insta.Media()
+	if len(mm) != 1 {
+		t.Fatalf("%d media published", len(mm))
+	}
+	if err := RunTakedown(context.Background(), e.a, mm[0].Code, "mod", "copyright"); err != nil {
+		t.Fatal(err)
+	}
+	if mm = e.insta.Media(); !mm[0].Deleted {
+		t.Error("the media was not deleted")
+	}
+	r, err := e.st.Get("post1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != store.StatusTakenDown || r.Takedown == nil || r.Takedown.Reason != "copyright" || r.Takedown.RequestedBy != "mod" {
+		t.Errorf("record %+v, takedown %+v", r, r.Takedown)
+	}
+	var bl Blocklist
+	if err := e.st.GetState(blocklistKey, &bl); err != nil {
+		t.Fatal(err)
+	}
+	if !bl.Contains("Author1") {
+		t.Errorf("author1 is not blocklisted: %+v", bl.Authors)
+	}
+	// taking it down again only blocklists
+	if err := RunTakedown(context.Background(), e.a, "post1", "mod", "copyright"); err != nil {
+		t.Fatal(err)
+	}
+	if n := e.count("media/" + mm[0].ID + "/delete/"); n != 1 {
+		t.Errorf("%d deletes", n)
+	}
+}
+
+// Watch takes down the posts whose Reddit source was removed since.
+func TestWatch(t *testing.T) {
+	e := newTestEnv(t)
+	for i := 0; i < 2; i++ {
+		if err := DoPost(context.Background(), e.a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.reddit.ss[0].RemovedByCategory = "moderator"
+	if err := Watch(context.Background(), e.a); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range e.insta.Media() {
+		if deleted := m.Caption == "Post number 1"; m.Deleted != deleted {
+			t.Errorf("%q deleted %v", m.Caption, m.Deleted)
+		}
+	}
+	r, err := e.st.Get("post1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != store.StatusTakenDown || r.Takedown == nil || r.Takedown.Reason != "reddit: removed by moderator" {
+		t.Errorf("record %+v, takedown %+v", r, r.Takedown)
+	}
+	// nothing is left to take down
+	if err := Watch(context.Background(), e.a); err != nil {
+		t.Fatal(err)
+	}
+	if n := e.count("accounts/login/"); n != 3 {
+		t.Errorf("%d logins, want 3", n)
+	}
+}
+
+// Authors blocklisted by processes at once are all kept.
+func TestBlockAuthorConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// a store of its own, like another process would have
+			err := BlockAuthor(store.New(dir), &BlockedAuthor{Name: fmt.Sprint("author", i), Time: time.Now()})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	var bl Blocklist
+	if err := store.New(dir).GetState(blocklistKey, &bl); err != nil {
+		t.Fatal(err)
+	}
+	if len(bl.Authors) != 20 {
+		t.Errorf("%d authors blocklisted, want 20", len(bl.Authors))
+	}
+}
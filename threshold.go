@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
+	"github.com/montanaflynn/stats"
+)
+
+type scoreObservation struct {
+	Score int       `json:"score"`
+	Seen  time.Time `json:"seen"`
+}
+
+// ScoreHistory is the rolling record of listing scores of a subreddit,
+// keyed by submission id so a post seen on many runs counts once.
+type ScoreHistory struct {
+	Scores map[string]scoreObservation `json:"scores"`
+}
+
+func scoreHistoryKey(sub string) string {
+	return "scores-" + strings.ToLower(sub)
+}
+
+// Observe adds the listing to the history and forgets
+// everything not seen within window.
+func (h *ScoreHistory) Observe(ss []reddit.Submission, now time.Time, window time.Duration) {
+	if h.Scores == nil {
+		h.Scores = map[string]scoreObservation{}
+	}
+	for _, s := range ss {
+		h.Scores[s.ID] = scoreObservation{Score: s.Score, Seen: now}
+	}
+	for id, o := range h.Scores {
+		if now.Sub(o.Seen) > window {
+			delete(h.Scores, id)
+		}
+	}
+}
+
+func scoreWindow(a *Account) time.Duration {
+	if a.ScoreWindow.Duration <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return a.ScoreWindow.Duration
+}
+
+// Threshold is the configured percentile of the history,
+// clamped to the account's floor and ceiling.
+func (h *ScoreHistory) Threshold(a *Account) (int, error) {
+	var scores stats.Float64Data
+	for _, o := range h.Scores {
+		scores = append(scores, float64(o.Score))
+	}
+	threshold := a.MinScore
+	if len(scores) > 0 {
+		p, err := stats.PercentileNearestRank(scores, a.ScorePercentile)
+		if err != nil {
+			return 0, err
+		}
+		threshold = int(p)
+	}
+	if threshold < a.MinScore {
+		threshold = a.MinScore
+	}
+	if a.MaxMinScore > 0 && threshold > a.MaxMinScore {
+		threshold = a.MaxMinScore
+	}
+	return threshold, nil
+}
+
+// EffectiveMinScore returns the minimum score for sub, the threshold of
+// its score history together with the listing ss. The stored history
+// is left alone, runs that post add to it with RecordScores.
+func EffectiveMinScore(a *Account, st *store.Store, sub string, ss []reddit.Submission) (int, error) {
+	if a.ScorePercentile <= 0 {
+		log.Printf("r/%s: minimum score %d", sub, a.MinScore)
+		return a.MinScore, nil
+	}
+	var h ScoreHistory
+	if err := st.GetState(scoreHistoryKey(sub), &h); err != nil {
+		return 0, err
+	}
+	window := scoreWindow(a)
+	h.Observe(ss, time.Now(), window)
+	threshold, err := h.Threshold(a)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("r/%s: minimum score %d (p%g of %d scores over %v, floor %d, ceiling %d)",
+		sub, threshold, a.ScorePercentile, len(h.Scores), window, a.MinScore, a.MaxMinScore)
+	return threshold, nil
+}
+
+// RecordScores adds the listing to the score history of sub, under
+// the store lock so the scores of other processes are kept.
+func RecordScores(a *Account, st *store.Store, sub string, ss []reddit.Submission) error {
+	if a.ScorePercentile <= 0 {
+		return nil
+	}
+	unlock, err := st.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	var h ScoreHistory
+	key := scoreHistoryKey(sub)
+	if err := st.GetState(key, &h); err != nil {
+		return err
+	}
+	h.Observe(ss, time.Now(), scoreWindow(a))
+	return st.PutState(key, &h)
+}
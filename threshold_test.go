@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LamaLamer/redigram/reddit"
+	"github.com/LamaLamer/redigram/store"
+)
+
+func TestScoreHistoryThreshold(t *testing.T) {
+	h := &ScoreHistory{}
+	var ss []reddit.Submission
+	for i := 1; i <= 10; i++ {
+		ss = append(ss, reddit.Submission{ID: fmt.Sprint(i), Score: 100 * i})
+	}
+	h.Observe(ss, time.Now(), time.Hour)
+	tests := []struct {
+		percentile     float64
+		floor, ceiling int
+		want           int
+	}{
+		{90, 0, 0, 900},
+		{50, 0, 0, 500},
+		{90, 950, 0, 950},
+		{90, 0, 700, 700},
+		{100, 200, 2000, 1000},
+	}
+	for _, tt := range tests {
+		a := &Account{ScorePercentile: tt.percentile, MinScore: tt.floor, MaxMinScore: tt.ceiling}
+		got, err := h.Threshold(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("p%g, floor %d, ceiling %d: %d, want %d", tt.percentile, tt.floor, tt.ceiling, got, tt.want)
+		}
+	}
+	if got, _ := (&ScoreHistory{}).Threshold(&Account{ScorePercentile: 90, MinScore: 42}); got != 42 {
+		t.Errorf("empty history: %d, want the floor", got)
+	}
+}
+
+func TestScoreHistoryObserve(t *testing.T) {
+	now := time.Now()
+	h := &ScoreHistory{}
+	h.Observe([]reddit.Submission{{ID: "a", Score: 1}, {ID: "b", Score: 2}}, now.Add(-2*time.Hour), time.Hour)
+	h.Observe([]reddit.Submission{{ID: "b", Score: 5}, {ID: "c", Score: 3}}, now, time.Hour)
+	if len(h.Scores) != 2 || h.Scores["b"].Score != 5 || h.Scores["c"].Score != 3 {
+		t.Errorf("scores %v", h.Scores)
+	}
+}
+
+// Only the posting path changes the score history.
+func TestScoreHistoryReadOnly(t *testing.T) {
+	e := newTestEnv(t)
+	e.a.ScorePercentile = 50
+	var h ScoreHistory
+	key := scoreHistoryKey("memes")
+	if _, err := EvaluateListing(context.Background(), e.a, e.st, "memes"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.st.GetState(key, &h); err != nil || len(h.Scores) != 0 {
+		t.Fatalf("evaluating recorded %d scores: %v", len(h.Scores), err)
+	}
+	if _, err := RankedCandidates(context.Background(), e.a, e.st, "memes"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.st.GetState(key, &h); err != nil || len(h.Scores) != 3 {
+		t.Fatalf("posting recorded %d scores: %v", len(h.Scores), err)
+	}
+}
+
+func TestEffectiveMinScore(t *testing.T) {
+	st := store.New(t.TempDir())
+	a := &Account{ScorePercentile: 100, MinScore: 10}
+	ss := []reddit.Submission{{ID: "a", Score: 300}}
+	if err := RecordScores(a, st, "Memes", ss); err != nil {
+		t.Fatal(err)
+	}
+	// the stored history and the listing at hand both count
+	got, err := EffectiveMinScore(a, st, "memes", []reddit.Submission{{ID: "b", Score: 200}})
+	if err != nil || got != 300 {
+		t.Errorf("got %d, %v, want 300", got, err)
+	}
+	got, err = EffectiveMinScore(a, st, "memes", []reddit.Submission{{ID: "b", Score: 500}})
+	if err != nil || got != 500 {
+		t.Errorf("got %d, %v, want 500", got, err)
+	}
+	a.ScorePercentile = 0
+	if got, _ := EffectiveMinScore(a, st, "memes", ss); got != 10 {
+		t.Errorf("without percentile: %d, want 10", got)
+	}
+}
+
+// Listings recorded by processes at once all end up in the history.
+func TestRecordScoresConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	a := &Account{ScorePercentile: 50}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// a store of its own, like another process would have
+			ss := []reddit.Submission{{ID: fmt.Sprint("s", i), Score: i}}
+			if err := RecordScores(a, store.New(dir), "memes", ss); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	var h ScoreHistory
+	if err := store.New(dir).GetState(scoreHistoryKey("memes"), &h); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Scores) != 20 {
+		t.Errorf("%d scores recorded, want 20", len(h.Scores))
+	}
+}